@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/meyskens/thomas-disco/pkg/music"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(NewCacheCmd())
+}
+
+type cacheCmdOptions struct {
+	storageOptions
+
+	MaxSize   int
+	OlderThan time.Duration
+	DryRun    bool
+	Delete    bool
+
+	cache music.SongCache
+	index *music.CacheIndex
+}
+
+// NewCacheCmd generates the `cache` command
+func NewCacheCmd() *cobra.Command {
+	s := cacheCmdOptions{}
+	c := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the song cache",
+		Long:  `List, prune, verify and fill the song cache that serve uses`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			err := initializeConfig(cmd)
+			if err != nil {
+				return err
+			}
+			return s.open()
+		},
+	}
+	s.storageOptions.AddFlags(c.PersistentFlags())
+
+	c.AddCommand(&cobra.Command{
+		Use:   "ls",
+		Short: "List the cached songs",
+		Args:  cobra.NoArgs,
+		RunE:  s.List,
+	})
+
+	c.AddCommand(&cobra.Command{
+		Use:   "rm <id>...",
+		Short: "Remove songs from the cache",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  s.Remove,
+	})
+
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove songs not played for a while or until the cache fits in a size",
+		Args:  cobra.NoArgs,
+		RunE:  s.Prune,
+	}
+	prune.Flags().IntVar(&s.MaxSize, "max-size", 0, "Remove the least recently played songs until the cache is at most this many MB, 0 for no limit")
+	prune.Flags().DurationVar(&s.OlderThan, "older-than", 0, "Remove songs not played for this long, 0 to keep all")
+	prune.Flags().BoolVar(&s.DryRun, "dry-run", false, "Only show what would be removed")
+	c.AddCommand(prune)
+
+	verify := &cobra.Command{
+		Use:   "verify",
+		Short: "Decode every cached song and report the corrupt ones",
+		Args:  cobra.NoArgs,
+		RunE:  s.Verify,
+	}
+	verify.Flags().BoolVar(&s.Delete, "delete", false, "Remove corrupt songs from the cache")
+	c.AddCommand(verify)
+
+	c.AddCommand(&cobra.Command{
+		Use:   "prewarm <playlist-url>",
+		Short: "Download and encode all songs of a playlist ahead of a party",
+		Long:  `Stores all songs of a playlist yt-dlp can read (YouTube, SoundCloud, Bandcamp...) in the cache`,
+		Args:  cobra.ExactArgs(1),
+		RunE:  s.Prewarm,
+	})
+
+	return c
+}
+
+func (s *cacheCmdOptions) open() error {
+	opts := s.MusicOptions()
+
+	var err error
+	s.index, err = music.NewCacheIndex(filepath.Join(opts.DataDir, "cache.json"))
+	if err != nil {
+		return err
+	}
+
+	s.cache, err = music.NewSongCache(opts, s.index)
+	if err != nil {
+		return err
+	}
+	if s.cache == nil {
+		return errors.New("No S3 bucket or cache directory specified")
+	}
+	return nil
+}
+
+// cachedSong is a song in the cache with what the index knows about it
+type cachedSong struct {
+	*music.CacheObject
+	entry music.CacheEntry
+}
+
+// lastUsed is when the song was last played, or stored if we do not know
+func (c cachedSong) lastUsed() time.Time {
+	if c.entry.LastPlayed.After(c.Modified) {
+		return c.entry.LastPlayed
+	}
+	return c.Modified
+}
+
+func (s *cacheCmdOptions) songs() ([]cachedSong, error) {
+	objects, err := s.cache.List()
+	if err != nil {
+		return nil, err
+	}
+
+	songs := []cachedSong{}
+	for _, o := range objects {
+		entry, _ := s.index.Get(o.Key)
+		songs = append(songs, cachedSong{o, entry})
+	}
+	return songs, nil
+}
+
+func (s *cacheCmdOptions) List(cmd *cobra.Command, args []string) error {
+	songs, err := s.songs()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSIZE\tAGE\tPLAYS\tTITLE")
+	var total int64
+	for _, song := range songs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", song.Key, formatSize(song.Size), formatAge(song.Modified), song.entry.Plays, song.entry.Title)
+		total += song.Size
+	}
+	w.Flush()
+
+	fmt.Printf("%d songs, %s\n", len(songs), formatSize(total))
+	return nil
+}
+
+func (s *cacheCmdOptions) Remove(cmd *cobra.Command, args []string) error {
+	for _, key := range args {
+		err := s.cache.Delete(key)
+		if err != nil {
+			return fmt.Errorf("error removing %s: %w", key, err)
+		}
+		s.index.Remove(key)
+		fmt.Printf("Removed %s\n", key)
+	}
+	return nil
+}
+
+func (s *cacheCmdOptions) Prune(cmd *cobra.Command, args []string) error {
+	if s.MaxSize <= 0 && s.OlderThan <= 0 {
+		return errors.New("Specify --max-size or --older-than")
+	}
+
+	songs, err := s.songs()
+	if err != nil {
+		return err
+	}
+
+	// least recently played first
+	sort.Slice(songs, func(i, j int) bool {
+		return songs[i].lastUsed().Before(songs[j].lastUsed())
+	})
+
+	var total int64
+	for _, song := range songs {
+		total += song.Size
+	}
+	maxSize := int64(s.MaxSize) * 1024 * 1024
+
+	removed := 0
+	for _, song := range songs {
+		tooOld := s.OlderThan > 0 && time.Since(song.lastUsed()) > s.OlderThan
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			break
+		}
+
+		if !s.DryRun {
+			err := s.cache.Delete(song.Key)
+			if err != nil {
+				log.Printf("Error removing %s: %v", song.Key, err)
+				continue
+			}
+			s.index.Remove(song.Key)
+		}
+		fmt.Printf("Removed %s (%s, last played %s ago)\n", song.Key, formatSize(song.Size), formatAge(song.lastUsed()))
+		total -= song.Size
+		removed++
+	}
+
+	fmt.Printf("Removed %d songs, %s left\n", removed, formatSize(total))
+	return nil
+}
+
+func (s *cacheCmdOptions) Verify(cmd *cobra.Command, args []string) error {
+	objects, err := s.cache.List()
+	if err != nil {
+		return err
+	}
+
+	corrupt := 0
+	for _, o := range objects {
+		err := music.VerifyCachedSong(s.cache, s.index, o.Key)
+		if err == nil {
+			continue
+		}
+
+		corrupt++
+		fmt.Printf("%s is corrupt: %v\n", o.Key, err)
+		if s.Delete {
+			err := s.cache.Delete(o.Key)
+			if err != nil {
+				log.Printf("Error removing %s: %v", o.Key, err)
+				continue
+			}
+			s.index.Remove(o.Key)
+		}
+	}
+
+	fmt.Printf("Verified %d songs, %d corrupt\n", len(objects), corrupt)
+	return nil
+}
+
+func (s *cacheCmdOptions) Prewarm(cmd *cobra.Command, args []string) error {
+	links, err := music.PlaylistLinks(args[0])
+	if err != nil {
+		return err
+	}
+	log.Printf("Found %d songs", len(links))
+
+	failed := 0
+	for n, link := range links {
+		song, err := music.FindSong(link)
+		if err != nil {
+			log.Printf("[%d/%d] Skipping %s: %v", n+1, len(links), link, err)
+			failed++
+			continue
+		}
+
+		if _, err := s.cache.Stat(song.CacheKey()); err == nil {
+			log.Printf("[%d/%d] Already have %q", n+1, len(links), song.Title)
+			continue
+		}
+
+		log.Printf("[%d/%d] Storing %q", n+1, len(links), song.Title)
+		err = music.StoreSong(s.cache, s.index, song)
+		if err != nil {
+			log.Printf("[%d/%d] Failed storing %q: %v", n+1, len(links), song.Title, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d songs failed", failed, len(links))
+	}
+	return nil
+}
+
+func formatSize(b int64) string {
+	return fmt.Sprintf("%.1f MB", float64(b)/1024/1024)
+}
+
+func formatAge(t time.Time) string {
+	age := time.Since(t)
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+}
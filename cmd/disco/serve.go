@@ -22,11 +22,18 @@ type serveCmdOptions struct {
 	Token        string
 	YouTubeToken string
 
-	S3Access   string
-	S3Bucket   string
-	S3Secret   string
-	S3Region   string
-	S3Endpoint string
+	storageOptions
+
+	MaxFileSize     int
+	MaxFileDuration time.Duration
+
+	RadioPresets map[string]string
+	Sounds       map[string]string
+	TTS          string
+	LyricsAPI    string
+
+	LibraryDir    string
+	LibraryRescan time.Duration
 
 	dg *discordgo.Session
 }
@@ -44,11 +51,15 @@ func NewServeCmd() *cobra.Command {
 
 	c.Flags().StringVar(&s.Token, "token", "", "Discord Bot Token")
 	c.Flags().StringVar(&s.YouTubeToken, "youtube-token", "", "YouTube API Token")
-	c.Flags().StringVar(&s.S3Access, "s3-access", "", "S3 Access Key")
-	c.Flags().StringVar(&s.S3Bucket, "s3-bucket", "", "S3 Bucket")
-	c.Flags().StringVar(&s.S3Secret, "s3-secret", "", "S3 Secret Key")
-	c.Flags().StringVar(&s.S3Region, "s3-region", "", "S3 Region")
-	c.Flags().StringVar(&s.S3Endpoint, "s3-endpoint", "", "S3 Endpoint")
+	s.storageOptions.AddFlags(c.Flags())
+	c.Flags().IntVar(&s.MaxFileSize, "max-file-size", 100, "Max size in MB of audio files played with /playfile or a direct link")
+	c.Flags().DurationVar(&s.MaxFileDuration, "max-file-duration", 2*time.Hour, "Max duration of audio files played with /playfile or a direct link")
+	c.Flags().StringVar(&s.LibraryDir, "library-dir", "", "Directory of local audio files to play with /library")
+	c.Flags().DurationVar(&s.LibraryRescan, "library-rescan", time.Hour, "How often to look for new files in the library directory, 0 to only scan at start")
+	c.Flags().StringToStringVar(&s.RadioPresets, "radio-preset", map[string]string{}, "Radio stations available to every guild as name=url")
+	c.Flags().StringVar(&s.TTS, "tts", "", "Text to speech engine to announce songs with: espeak-ng, piper:<directory of <language>.onnx voices> or a http url with {text} and {lang} in it")
+	c.Flags().StringVar(&s.LyricsAPI, "lyrics-api", "", "LRCLIB compatible API to find lyrics for /lyrics and /karaoke with, eg. https://lrclib.net. Library tracks can have a .lrc file next to them")
+	c.Flags().StringToStringVar(&s.Sounds, "sfx", map[string]string{}, "Sounds available to every guild with /sfx as name=file, eg. airhorn=/sounds/airhorn.ogg")
 
 	c.MarkFlagRequired("token")
 	c.MarkFlagRequired("youtube-token")
@@ -79,14 +90,18 @@ func (s *serveCmdOptions) RunE(cmd *cobra.Command, args []string) error {
 	}
 	defer s.dg.Close()
 
-	mc, err := music.NewMusicCommand(s.dg, music.MusicOptions{
-		YoutubeToken: s.YouTubeToken,
-		S3Access:     s.S3Access,
-		S3Bucket:     s.S3Bucket,
-		S3Secret:     s.S3Secret,
-		S3Region:     s.S3Region,
-		S3Endpoint:   s.S3Endpoint,
-	})
+	opts := s.MusicOptions()
+	opts.YoutubeToken = s.YouTubeToken
+	opts.MaxFileSize = int64(s.MaxFileSize) * 1024 * 1024
+	opts.MaxFileDuration = s.MaxFileDuration
+	opts.RadioPresets = s.RadioPresets
+	opts.Sounds = s.Sounds
+	opts.TTS = s.TTS
+	opts.LyricsAPI = s.LyricsAPI
+	opts.LibraryDir = s.LibraryDir
+	opts.LibraryRescan = s.LibraryRescan
+
+	mc, err := music.NewMusicCommand(s.dg, opts)
 	if err != nil {
 		return err
 	}
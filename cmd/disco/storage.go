@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/meyskens/thomas-disco/pkg/music"
+	"github.com/spf13/pflag"
+)
+
+// storageOptions are the flags for where songs and data are kept, shared by serve and cache
+type storageOptions struct {
+	S3Access   string
+	S3Bucket   string
+	S3Secret   string
+	S3Region   string
+	S3Endpoint string
+
+	CacheDir     string
+	CacheMaxSize int
+
+	DataDir string
+}
+
+// AddFlags adds the storage flags to a flag set
+func (s *storageOptions) AddFlags(f *pflag.FlagSet) {
+	f.StringVar(&s.S3Access, "s3-access", "", "S3 Access Key")
+	f.StringVar(&s.S3Bucket, "s3-bucket", "", "S3 Bucket")
+	f.StringVar(&s.S3Secret, "s3-secret", "", "S3 Secret Key")
+	f.StringVar(&s.S3Region, "s3-region", "", "S3 Region")
+	f.StringVar(&s.S3Endpoint, "s3-endpoint", "", "S3 Endpoint")
+	f.StringVar(&s.CacheDir, "cache-dir", "", "Directory to cache songs in when no S3 bucket is set")
+	f.IntVar(&s.CacheMaxSize, "cache-max-size", 0, "Max size in MB of the cache directory, least recently played songs are removed first, 0 for no limit")
+	f.StringVar(&s.DataDir, "data-dir", ".", "Directory to keep guild settings, podcast positions, the library and cache index in")
+}
+
+// MusicOptions returns music options with the storage filled in
+func (s *storageOptions) MusicOptions() music.MusicOptions {
+	return music.MusicOptions{
+		S3Access:   s.S3Access,
+		S3Bucket:   s.S3Bucket,
+		S3Secret:   s.S3Secret,
+		S3Region:   s.S3Region,
+		S3Endpoint: s.S3Endpoint,
+
+		CacheDir:     s.CacheDir,
+		CacheMaxSize: int64(s.CacheMaxSize) * 1024 * 1024,
+
+		DataDir: s.DataDir,
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// decode writes a dca file as an Ogg Opus file, the song info becomes Vorbis comments
+func decode(in io.Reader, out io.Writer) error {
+	decoder := dca.NewDecoder(in)
+
+	// the metadata is read with the first frame
+	first, err := decoder.OpusFrame()
+	if err != nil {
+		return err
+	}
+
+	channels := Channels
+	var comments []string
+	if decoder.Metadata != nil {
+		if decoder.Metadata.Opus != nil && decoder.Metadata.Opus.Channels > 0 {
+			channels = decoder.Metadata.Opus.Channels
+		}
+		if decoder.Metadata.SongInfo != nil {
+			comments = decoder.Metadata.SongInfo.VorbisComments()
+		}
+	}
+
+	o, err := dca.NewOggWriter(out, channels, comments...)
+	if err != nil {
+		return err
+	}
+
+	frame := first
+	for {
+		err = o.WriteFrame(frame)
+		if err != nil {
+			return err
+		}
+
+		frame, err = decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.Close()
+}
+
+// bitrate buckets of the histogram in kb/s
+const histogramStep = 16
+
+// info prints what is in a dca file
+func info(in io.Reader, out io.Writer) error {
+	decoder := dca.NewDecoder(in)
+
+	frames := 0
+	var size int
+	histogram := map[int]int{}
+	for {
+		frame, err := decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", frames, err)
+		}
+
+		frames++
+		size += len(frame)
+		kbps := len(frame) * 8 / int(decoder.FrameDuration()/time.Millisecond)
+		histogram[kbps/histogramStep]++
+	}
+
+	fmt.Fprintf(out, "Format version: %d\n", decoder.FormatVersion)
+	if decoder.Metadata != nil {
+		metadata := *decoder.Metadata
+		if metadata.SongInfo != nil && metadata.SongInfo.Cover != nil {
+			// nobody wants to read the base64
+			songInfo := *metadata.SongInfo
+			cover := fmt.Sprintf("(%d bytes)", len(*songInfo.Cover))
+			songInfo.Cover = &cover
+			metadata.SongInfo = &songInfo
+		}
+
+		jsonData, err := json.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Metadata: %s\n", jsonData)
+	} else {
+		fmt.Fprintln(out, "Metadata: none, raw frames")
+	}
+
+	duration := time.Duration(frames) * decoder.FrameDuration()
+	fmt.Fprintf(out, "Frames: %d\n", frames)
+	fmt.Fprintf(out, "Duration: %s\n", duration)
+	if frames == 0 {
+		return nil
+	}
+	fmt.Fprintf(out, "Average bitrate: %.1f kb/s\n", float64(size)*8/duration.Seconds()/1000)
+
+	min, max, most := -1, 0, 0
+	for bucket, n := range histogram {
+		if min < 0 || bucket < min {
+			min = bucket
+		}
+		if bucket > max {
+			max = bucket
+		}
+		if n > most {
+			most = n
+		}
+	}
+
+	fmt.Fprintln(out, "Bitrate histogram (kb/s):")
+	for bucket := min; bucket <= max; bucket++ {
+		bar := strings.Repeat("#", (histogram[bucket]*40+most-1)/most)
+		fmt.Fprintf(out, "%4d-%-4d %-40s %d\n", bucket*histogramStep, (bucket+1)*histogramStep-1, bar, histogram[bucket])
+	}
+
+	return nil
+}
@@ -53,6 +53,9 @@ var (
 
 	Quiet bool // disable all stats output
 
+	Decode bool // convert a dca file to ogg opus instead of encoding
+	Info   bool // print what is in a dca file instead of encoding
+
 	err error
 )
 
@@ -72,6 +75,8 @@ func init() {
 	flag.StringVar(&CoverFormat, "cf", "jpeg", "format the cover art will be encoded with")
 	flag.StringVar(&Comment, "com", "", "leave a comment in the metadata")
 	flag.BoolVar(&Quiet, "quiet", false, "disable stats output to stderr")
+	flag.BoolVar(&Decode, "d", false, "decode a dca file to ogg opus")
+	flag.BoolVar(&Info, "info", false, "print the metadata, duration and bitrates of a dca file")
 
 	flag.Parse()
 }
@@ -84,9 +89,21 @@ func main() {
 	// BLOCK : Basic setup and validation
 	//////////////////////////////////////////////////////////////////////////
 
+	// dca decode file.dca and dca info file.dca
+	args := flag.Args()
+	if len(args) > 0 && (args[0] == "decode" || args[0] == "info") {
+		Decode = args[0] == "decode"
+		Info = args[0] == "info"
+		args = args[1:]
+	}
+
 	// If only one argument provided assume it's a filename.
-	if len(os.Args) == 2 {
-		InFile = os.Args[1]
+	if len(args) == 1 {
+		InFile = args[0]
+	}
+
+	if Decode || Info {
+		os.Exit(readDCA())
 	}
 
 	// If reading from a file, verify it exists.
@@ -144,7 +161,7 @@ func main() {
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed creating an encoding session: ", err)
+		fmt.Fprintln(os.Stderr, "Failed creating an encoding session:", err)
 		os.Exit(1)
 	}
 
@@ -162,6 +179,30 @@ func main() {
 	}
 }
 
+// readDCA runs the decode and info modes, it returns the exit code
+func readDCA() int {
+	in := os.Stdin
+	if InFile != "pipe:0" {
+		in, err = os.Open(InFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed opening the dca file:", err)
+			return 1
+		}
+		defer in.Close()
+	}
+
+	if Info {
+		err = info(in, os.Stdout)
+	} else {
+		err = decode(in, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading the dca file:", err)
+		return 1
+	}
+	return 0
+}
+
 func statusPrinter(session *dca.EncodeSession) {
 	ticker := time.NewTicker(time.Millisecond * 500)
 	for {
@@ -23,12 +23,28 @@ type Decoder struct {
 
 	// Set to true after the first frame has been read
 	firstFrameProcessed bool
+
+	src   io.Reader
+	base  int64 // offset of the file in src
+	pos   int64 // offset of the next frame in the file
+	frame int   // number of the next frame
+
+	index       *FrameIndex
+	indexLoaded bool // the index came from the file, otherwise it is built while reading
+	ended       bool
 }
 
-// NewDecoder returns a new dca decoder
+// NewDecoder returns a new dca decoder,
+// if r is an io.ReadSeeker the decoder can also seek backwards
 func NewDecoder(r io.Reader) *Decoder {
 	decoder := &Decoder{
-		r: bufio.NewReader(r),
+		r:     bufio.NewReader(r),
+		src:   r,
+		index: newFrameIndex(),
+	}
+
+	if rs, ok := r.(io.ReadSeeker); ok {
+		decoder.base, _ = rs.Seek(0, io.SeekCurrent)
 	}
 
 	return decoder
@@ -75,6 +91,8 @@ func (d *Decoder) ReadMetadata() error {
 		return err
 	}
 
+	d.pos = int64(8 + metaLen)
+
 	// And unmarshal it
 	var metadata *Metadata
 	err = json.Unmarshal(jsonBuf, &metadata)
@@ -85,32 +103,179 @@ func (d *Decoder) ReadMetadata() error {
 // OpusFrame returns the next audio frame
 // If this is the first frame it will also check for metadata in it
 func (d *Decoder) OpusFrame() (frame []byte, err error) {
-	if !d.firstFrameProcessed {
-		// Check to see if this contains metadata and read the metadata if so
-		magic, err := d.r.Peek(3)
-		if err != nil {
-			return nil, err
-		}
+	err = d.readFirstFrame()
+	if err != nil {
+		return nil, err
+	}
 
-		if string(magic) == "DCA" {
-			err = d.ReadMetadata()
+	if d.ended {
+		return nil, io.EOF
+	}
+
+	if d.FormatVersion >= int(IndexedFormatVersion) {
+		size, err := d.r.Peek(2)
+		if err == nil && int16(binary.LittleEndian.Uint16(size)) == indexMarker {
+			// the frames are over, the index follows
+			d.ended = true
+			d.r.Discard(2)
+			index, err := readFrameIndex(d.r)
 			if err != nil {
 				return nil, err
 			}
+			d.index = index
+			d.indexLoaded = true
+			return nil, io.EOF
 		}
 	}
 
+	if !d.indexLoaded {
+		d.index.add(d.frame, d.pos)
+	}
+
 	frame, err = DecodeFrame(d.r)
+	if err != nil {
+		return
+	}
+	d.pos += int64(2 + len(frame))
+	d.frame++
 	return
 }
 
+// readFirstFrame reads the metadata if there is any
+func (d *Decoder) readFirstFrame() error {
+	if d.firstFrameProcessed {
+		return nil
+	}
+
+	// Check to see if this contains metadata and read the metadata if so
+	magic, err := d.r.Peek(3)
+	if err != nil {
+		return err
+	}
+
+	if string(magic) == "DCA" {
+		return d.ReadMetadata()
+	}
+	return nil
+}
+
+// Seek continues reading at the frame playing at t,
+// it returns io.EOF if the audio is shorter than t.
+// Files without an index are read from the start to find the frame,
+// seeking backwards is only possible if the reader is an io.ReadSeeker.
+func (d *Decoder) Seek(t time.Duration) error {
+	err := d.readFirstFrame()
+	if err != nil {
+		return err
+	}
+
+	target := int(t / d.FrameDuration())
+	rs, seekable := d.src.(io.ReadSeeker)
+
+	if seekable && d.FormatVersion >= int(IndexedFormatVersion) && !d.indexLoaded {
+		err = d.loadIndex(rs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if seekable && len(d.index.Offsets) > 0 {
+		// jump to the closest frame we know before the target
+		entry := target / d.index.Interval
+		if entry >= len(d.index.Offsets) {
+			entry = len(d.index.Offsets) - 1
+		}
+		frame := entry * d.index.Interval
+		if target < d.frame || frame > d.frame {
+			err = d.jump(rs, d.index.Offsets[entry], frame)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if target < d.frame {
+		return ErrNotSeekable
+	}
+
+	for d.frame < target {
+		_, err := d.OpusFrame()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndex reads the index at the end of a version 2 file,
+// it is fine if there is none
+func (d *Decoder) loadIndex(rs io.ReadSeeker) error {
+	_, err := rs.Seek(-8, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var trailer struct {
+		Size  uint32
+		Magic [4]byte
+	}
+	err = binary.Read(rs, binary.LittleEndian, &trailer)
+	if err != nil {
+		return err
+	}
+
+	if string(trailer.Magic[:]) == "DCAI" {
+		_, err = rs.Seek(-int64(trailer.Size), io.SeekEnd)
+		if err != nil {
+			return err
+		}
+
+		var marker int16
+		err = binary.Read(rs, binary.LittleEndian, &marker)
+		if err != nil {
+			return err
+		}
+		if marker != indexMarker {
+			return ErrBadIndex
+		}
+
+		d.index, err = readFrameIndex(rs)
+		if err != nil {
+			return err
+		}
+		d.indexLoaded = true
+	}
+
+	// go back to where we were
+	return d.jump(rs, d.pos, d.frame)
+}
+
+// jump continues reading at a frame of which we know the offset
+func (d *Decoder) jump(rs io.ReadSeeker, offset int64, frame int) error {
+	_, err := rs.Seek(d.base+offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	d.r.Reset(rs)
+	d.pos = offset
+	d.frame = frame
+	d.ended = false
+	return nil
+}
+
 // FrameDuration implements OpusReader, returnining the specified duration per frame
 func (d *Decoder) FrameDuration() time.Duration {
-	if d.Metadata == nil {
-		return 20
+	if d.Metadata == nil || d.Metadata.Opus == nil || d.Metadata.Opus.Channels == 0 {
+		return 20 * time.Millisecond
 	}
 
 	// I don't understand nick, why does it have to be like this nick, please nick, im not having a good time nick.
 	// 960B = pcm framesize of 20ms 1 channel audio
-	return time.Duration(((d.Metadata.Opus.FrameSize/d.Metadata.Opus.Channels)/960)*20) * time.Millisecond
+	duration := time.Duration(((d.Metadata.Opus.FrameSize/d.Metadata.Opus.Channels)/960)*20) * time.Millisecond
+	if duration <= 0 {
+		// older encoders wrote the frame size of a single channel
+		return 20 * time.Millisecond
+	}
+	return duration
 }
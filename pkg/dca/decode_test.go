@@ -1,9 +1,11 @@
 package dca
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDecode(t *testing.T) {
@@ -35,3 +37,88 @@ func TestDecode(t *testing.T) {
 		t.Error("Incorrect number of frames")
 	}
 }
+
+func TestSeek(t *testing.T) {
+	frames := testFrames(t)
+
+	file, err := os.Open("testaudio.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	decoder := NewDecoder(file)
+	err = decoder.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewIndexedWriter(&buf, decoder.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		err = w.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := buf.Bytes()
+
+	// the index is not a frame
+	got := readAllFrames(t, NewDecoder(bytes.NewReader(indexed)))
+	if len(got) != len(frames) {
+		t.Fatalf("Incorrect number of frames (got %d expected %d)", len(got), len(frames))
+	}
+
+	checkSeek := func(t *testing.T, d *Decoder, to time.Duration, want int) {
+		err := d.Seek(to)
+		if err != nil {
+			t.Fatalf("seeking to %s: %v", to, err)
+		}
+		frame, err := d.OpusFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, frames[want]) {
+			t.Errorf("seeking to %s did not get frame %d", to, want)
+		}
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		d := NewDecoder(bytes.NewReader(indexed))
+		checkSeek(t, d, 10*time.Second, 500)
+		if !d.indexLoaded {
+			t.Error("expected the index at the end to be used")
+		}
+		checkSeek(t, d, 2*time.Second+10*time.Millisecond, 100)
+		checkSeek(t, d, 0, 0)
+
+		err := d.Seek(time.Minute)
+		if err != io.EOF {
+			t.Errorf("expected io.EOF seeking past the end, got %v", err)
+		}
+	})
+
+	t.Run("version 1", func(t *testing.T) {
+		file.Seek(0, io.SeekStart)
+		d := NewDecoder(file)
+		checkSeek(t, d, 5*time.Second, 250)
+		checkSeek(t, d, time.Second, 50)
+		checkSeek(t, d, 14*time.Second, 700)
+	})
+
+	t.Run("not seekable", func(t *testing.T) {
+		d := NewDecoder(struct{ io.Reader }{bytes.NewReader(indexed)})
+		checkSeek(t, d, 5*time.Second, 250)
+
+		err := d.Seek(time.Second)
+		if err != ErrNotSeekable {
+			t.Errorf("expected ErrNotSeekable, got %v", err)
+		}
+	})
+}
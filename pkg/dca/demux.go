@@ -0,0 +1,516 @@
+package dca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/jonas747/ogg"
+)
+
+var (
+	ErrNotOpus         = errors.New("No opus audio found")
+	ErrOpusUnsupported = errors.New("Opus audio can not be sent to discord as it is")
+	ErrBadWebM         = errors.New("Corrupt WebM")
+)
+
+// Demuxer reads opus packets straight out of an Ogg or WebM container,
+// they are sent to discord as they are without ffmpeg
+type Demuxer struct {
+	next     func() ([]byte, error)
+	first    []byte
+	channels int
+	samples  int64
+}
+
+// NewDemuxer reads the headers of an Ogg or WebM file,
+// it returns ErrNotOpus or ErrOpusUnsupported if the audio has to go through ffmpeg
+func NewDemuxer(r io.Reader) (*Demuxer, error) {
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(magic), r)
+
+	switch {
+	case string(magic) == "OggS":
+		return NewOggDemuxer(r)
+	case binary.BigEndian.Uint32(magic) == webmEBML:
+		return NewWebMDemuxer(r)
+	}
+	return nil, ErrNotOpus
+}
+
+// NewOggDemuxer reads an Ogg Opus stream (RFC 7845)
+func NewOggDemuxer(r io.Reader) (*Demuxer, error) {
+	decoder := ogg.NewPacketDecoder(ogg.NewDecoder(r))
+
+	head, _, err := decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+	channels, err := parseOpusHead(head)
+	if err != nil {
+		return nil, err
+	}
+
+	// the second packet has the comments
+	_, _, err = decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	next := func() ([]byte, error) {
+		for {
+			packet, _, err := decoder.Decode()
+			if err != nil {
+				return nil, err
+			}
+			// the end of the stream can be an empty packet
+			if len(packet) > 0 {
+				return packet, nil
+			}
+		}
+	}
+
+	return newDemuxer(next, channels)
+}
+
+// NewWebMDemuxer reads the first opus track of a WebM or Matroska file
+func NewWebMDemuxer(r io.Reader) (*Demuxer, error) {
+	w := &webmReader{r: bufio.NewReader(r)}
+
+	// the tracks are known once we found the first block
+	packet, err := w.next()
+	if err == io.EOF {
+		return nil, ErrNotOpus
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	channels, err := parseOpusHead(w.opus.private)
+	if err != nil {
+		return nil, err
+	}
+
+	first := true
+	next := func() ([]byte, error) {
+		if first {
+			first = false
+			return packet, nil
+		}
+		return w.next()
+	}
+
+	return newDemuxer(next, channels)
+}
+
+// newDemuxer checks the first packet, discord wants 20ms frames
+func newDemuxer(next func() ([]byte, error), channels int) (*Demuxer, error) {
+	first, err := next()
+	if err == io.EOF {
+		return nil, ErrNotOpus
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := opusSamples(first)
+	if err != nil {
+		return nil, err
+	}
+	if samples != 960 {
+		return nil, ErrOpusUnsupported
+	}
+
+	return &Demuxer{
+		next:     next,
+		first:    first,
+		channels: channels,
+	}, nil
+}
+
+// OpusFrame implements OpusReader, returning the next opus packet of the container
+func (d *Demuxer) OpusFrame() (frame []byte, err error) {
+	if d.first != nil {
+		frame, d.first = d.first, nil
+	} else {
+		frame, err = d.next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	samples, err := opusSamples(frame)
+	if err != nil {
+		return nil, err
+	}
+	d.samples += int64(samples)
+
+	return frame, nil
+}
+
+// FrameDuration implements OpusReader, we only pass through 20ms frames
+func (d *Demuxer) FrameDuration() time.Duration {
+	return 20 * time.Millisecond
+}
+
+// Channels returns the number of channels of the opus stream
+func (d *Demuxer) Channels() int {
+	return d.channels
+}
+
+// Duration returns how much audio was read so far
+func (d *Demuxer) Duration() time.Duration {
+	return time.Duration(d.samples) * time.Second / 48000
+}
+
+// parseOpusHead returns the channels of an OpusHead packet if discord can play them
+func parseOpusHead(head []byte) (int, error) {
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return 0, ErrNotOpus
+	}
+
+	channels := int(head[9])
+	mappingFamily := head[18]
+	if channels < 1 || channels > 2 || mappingFamily > 1 {
+		// surround sound has to be mixed down by ffmpeg
+		return 0, ErrOpusUnsupported
+	}
+
+	return channels, nil
+}
+
+// Passthrough returns true if the options do not change the audio,
+// so opus audio does not have to be encoded again. The loudness is not measured then.
+func (opts *EncodeOptions) Passthrough() bool {
+	return opts.Volume == 256 && opts.StartTime == 0 && opts.AudioFilter == "" && opts.FrameDuration == 20
+}
+
+// DemuxOrEncode returns the opus packets of r as they are if they can be played as is,
+// otherwise r is encoded by ffmpeg and the EncodeSession is returned too
+func DemuxOrEncode(r io.Reader, options *EncodeOptions) (OpusReader, *EncodeSession, error) {
+	return DemuxOrEncodeContext(context.Background(), r, options)
+}
+
+// DemuxOrEncodeContext is DemuxOrEncode with an encode session that stops when ctx is done
+func DemuxOrEncodeContext(ctx context.Context, r io.Reader, options *EncodeOptions) (OpusReader, *EncodeSession, error) {
+	if options.Passthrough() {
+		// keep what the demuxer read so ffmpeg can have it if we can't pass it through
+		probe := &replayReader{r: r}
+		demuxer, err := NewDemuxer(probe)
+		if err == nil {
+			// the headers are fine, the rest of the song does not have to be kept
+			probe.Forget()
+			return demuxer, nil, nil
+		}
+		if err != ErrNotOpus {
+			logln("Not passing opus through:", err)
+		}
+		r = probe.Replay()
+	}
+
+	session, err := EncodeMemContext(ctx, r, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, session, nil
+}
+
+// replayReader keeps what is read from r until Forget is called, so it can be read again
+type replayReader struct {
+	r      io.Reader
+	read   bytes.Buffer
+	forget bool
+}
+
+func (p *replayReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if !p.forget {
+		p.read.Write(b[:n])
+	}
+	return n, err
+}
+
+// Forget stops keeping what is read and drops what was kept
+func (p *replayReader) Forget() {
+	p.forget = true
+	p.read = bytes.Buffer{}
+}
+
+// Replay returns a reader that starts with what was read so far
+func (p *replayReader) Replay() io.Reader {
+	return io.MultiReader(bytes.NewReader(p.read.Bytes()), p.r)
+}
+
+// Matroska element IDs we need, see https://www.matroska.org/technical/elements.html
+const (
+	webmEBML         = 0x1A45DFA3
+	webmSegment      = 0x18538067
+	webmTracks       = 0x1654AE6B
+	webmTrackEntry   = 0xAE
+	webmTrackNumber  = 0xD7
+	webmCodecID      = 0x86
+	webmCodecPrivate = 0x63A2
+	webmCluster      = 0x1F43B675
+	webmBlockGroup   = 0xA0
+	webmBlock        = 0xA1
+	webmSimpleBlock  = 0xA3
+
+	webmUnknownSize = 1<<56 - 1
+	// blocks of audio are small, anything bigger is broken
+	webmMaxElementSize = 16 * 1024 * 1024
+)
+
+type webmTrack struct {
+	number  uint64
+	codec   string
+	private []byte
+}
+
+// webmReader walks through the elements of a WebM file, only keeping what it needs for the audio
+type webmReader struct {
+	r *bufio.Reader
+
+	tracks []*webmTrack
+	opus   *webmTrack
+	frames [][]byte // frames left of a laced block
+}
+
+// next returns the next opus packet
+func (w *webmReader) next() ([]byte, error) {
+	for len(w.frames) == 0 {
+		id, err := readVint(w.r, true)
+		if err != nil {
+			return nil, err
+		}
+		size, err := readVint(w.r, false)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case webmSegment, webmTracks, webmBlockGroup:
+			// we read the elements inside
+		case webmTrackEntry:
+			w.tracks = append(w.tracks, &webmTrack{})
+		case webmCluster:
+			if w.opus == nil {
+				for _, t := range w.tracks {
+					if t.codec == "A_OPUS" {
+						w.opus = t
+						break
+					}
+				}
+			}
+			if w.opus == nil {
+				return nil, ErrNotOpus
+			}
+		case webmTrackNumber, webmCodecID, webmCodecPrivate, webmBlock, webmSimpleBlock:
+			data, err := w.read(size)
+			if err != nil {
+				return nil, err
+			}
+			err = w.handle(id, data)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if size == webmUnknownSize {
+				return nil, ErrBadWebM
+			}
+			_, err = io.CopyN(ioutil.Discard, w.r, int64(size))
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	frame := w.frames[0]
+	w.frames = w.frames[1:]
+	return frame, nil
+}
+
+func (w *webmReader) read(size uint64) ([]byte, error) {
+	if size > webmMaxElementSize {
+		return nil, ErrBadWebM
+	}
+	data := make([]byte, size)
+	_, err := io.ReadFull(w.r, data)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+func (w *webmReader) handle(id uint64, data []byte) error {
+	var track *webmTrack
+	if len(w.tracks) > 0 {
+		track = w.tracks[len(w.tracks)-1]
+	}
+
+	switch id {
+	case webmTrackNumber:
+		if track == nil {
+			return ErrBadWebM
+		}
+		for _, b := range data {
+			track.number = track.number<<8 | uint64(b)
+		}
+	case webmCodecID:
+		if track == nil {
+			return ErrBadWebM
+		}
+		track.codec = string(bytes.TrimRight(data, "\x00"))
+	case webmCodecPrivate:
+		if track == nil {
+			return ErrBadWebM
+		}
+		track.private = data
+	case webmBlock, webmSimpleBlock:
+		if w.opus == nil {
+			return ErrNotOpus
+		}
+		return w.parseBlock(data)
+	}
+	return nil
+}
+
+// parseBlock splits a block of the opus track into frames
+func (w *webmReader) parseBlock(data []byte) error {
+	r := bytes.NewReader(data)
+	number, err := readVint(r, false)
+	if err != nil {
+		return ErrBadWebM
+	}
+	if number != w.opus.number {
+		return nil
+	}
+
+	// timecode and flags
+	header := make([]byte, 3)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return ErrBadWebM
+	}
+	lacing := (header[2] >> 1) & 3
+	if lacing == 0 {
+		w.frames = [][]byte{data[len(data)-r.Len():]}
+		return nil
+	}
+
+	count, err := r.ReadByte()
+	if err != nil {
+		return ErrBadWebM
+	}
+	sizes := make([]int, int(count)+1)
+
+	switch lacing {
+	case 1: // Xiph
+		for i := 0; i < len(sizes)-1; i++ {
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return ErrBadWebM
+				}
+				sizes[i] += int(b)
+				if b < 255 {
+					break
+				}
+			}
+		}
+	case 3: // EBML, the sizes after the first are differences
+		for i := 0; i < len(sizes)-1; i++ {
+			v, n, err := readVintLen(r, false)
+			if err != nil {
+				return ErrBadWebM
+			}
+			if i == 0 {
+				sizes[i] = int(v)
+				continue
+			}
+			diff := int(v) - (1<<(7*n-1) - 1)
+			sizes[i] = sizes[i-1] + diff
+		}
+	}
+
+	rest := r.Len()
+	if lacing == 2 { // fixed size
+		for i := range sizes {
+			sizes[i] = rest / len(sizes)
+		}
+	} else {
+		for _, s := range sizes[:len(sizes)-1] {
+			rest -= s
+		}
+		sizes[len(sizes)-1] = rest
+	}
+
+	pos := len(data) - r.Len()
+	w.frames = nil
+	for _, s := range sizes {
+		if s < 0 || pos+s > len(data) {
+			return ErrBadWebM
+		}
+		w.frames = append(w.frames, data[pos:pos+s])
+		pos += s
+	}
+	return nil
+}
+
+// readVint reads an EBML variable size integer,
+// IDs keep their length marker, sizes of all ones are webmUnknownSize
+func readVint(r io.ByteReader, keepMarker bool) (uint64, error) {
+	v, _, err := readVintLen(r, keepMarker)
+	return v, err
+}
+
+func readVintLen(r io.ByteReader, keepMarker bool) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if first == 0 {
+		return 0, 0, ErrBadWebM
+	}
+
+	length := 1
+	for mask := byte(0x80); first&mask == 0; mask >>= 1 {
+		length++
+	}
+
+	v := uint64(first)
+	if !keepMarker {
+		v &= uint64(0xFF >> length)
+	}
+	allOnes := v == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		v = v<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+
+	if !keepMarker && allOnes {
+		return webmUnknownSize, length, nil
+	}
+	return v, length, nil
+}
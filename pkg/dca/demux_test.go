@@ -0,0 +1,203 @@
+package dca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testFrames returns the opus frames of testaudio.dca
+func testFrames(t *testing.T) [][]byte {
+	file, err := os.Open("testaudio.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	decoder := NewDecoder(file)
+	frames := [][]byte{}
+	for {
+		frame, err := decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func readAllFrames(t *testing.T, r OpusReader) [][]byte {
+	frames := [][]byte{}
+	for {
+		frame, err := r.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestOggDemuxer(t *testing.T) {
+	frames := testFrames(t)
+
+	var buf bytes.Buffer
+	o, err := NewOggWriter(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		err = o.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	r, session, err := DemuxOrEncode(&buf, StdEncodeOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session != nil {
+		t.Fatal("expected the opus to pass through without ffmpeg")
+	}
+
+	got := readAllFrames(t, r)
+	if len(got) != len(frames) {
+		t.Fatalf("Incorrect number of frames (got %d expected %d)", len(got), len(frames))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], frames[i]) {
+			t.Fatalf("frame %d is different", i)
+		}
+	}
+
+	d := r.(*Demuxer)
+	if d.Channels() != 2 {
+		t.Errorf("expected 2 channels, got %d", d.Channels())
+	}
+	if d.Duration() != time.Duration(len(frames))*20*time.Millisecond {
+		t.Errorf("unexpected duration %s", d.Duration())
+	}
+}
+
+func TestReplayReader(t *testing.T) {
+	probe := &replayReader{r: bytes.NewReader([]byte("headers and the rest"))}
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(probe, head); err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(probe.Replay())
+	if err != nil || string(all) != "headers and the rest" {
+		t.Fatalf("expected the headers to be replayed, got %q (%v)", all, err)
+	}
+
+	probe = &replayReader{r: bytes.NewReader([]byte("headers and the rest"))}
+	io.ReadFull(probe, head)
+	probe.Forget()
+	io.ReadFull(probe, head)
+	if probe.read.Len() != 0 {
+		t.Errorf("expected nothing to be kept after Forget, got %q", probe.read.String())
+	}
+}
+
+func TestDemuxerNotOpus(t *testing.T) {
+	file, err := os.Open("testaudio.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = NewDemuxer(file)
+	if err != ErrNotOpus {
+		t.Errorf("expected ErrNotOpus for vorbis, got %v", err)
+	}
+}
+
+// webmElement encodes an element with an 8 byte size
+func webmElement(id uint32, data ...[]byte) []byte {
+	var buf bytes.Buffer
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	buf.Write(bytes.TrimLeft(idBytes, "\x00"))
+
+	body := bytes.Join(data, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	buf.Write(size)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestWebMDemuxer(t *testing.T) {
+	frames := testFrames(t)
+
+	head := &bytes.Buffer{}
+	head.WriteString("OpusHead")
+	head.Write([]byte{1, 2, 0, 0, 0x80, 0xBB, 0, 0, 0, 0, 0})
+
+	blocks := [][]byte{}
+	// a video track to skip
+	for _, frame := range frames[:len(frames)-3] {
+		blocks = append(blocks, webmElement(webmSimpleBlock, []byte{0x82, 0, 0, 0x80}, frame))
+		blocks = append(blocks, webmElement(webmSimpleBlock, []byte{0x81, 0, 0, 0x80}, []byte("video")))
+	}
+	// the last frames are Xiph laced in a block group
+	last := frames[len(frames)-3:]
+	laced := []byte{0x82, 0, 0, 0x02, 2}
+	for _, frame := range last[:2] {
+		for n := len(frame); ; n -= 255 {
+			if n < 255 {
+				laced = append(laced, byte(n))
+				break
+			}
+			laced = append(laced, 255)
+		}
+	}
+	blocks = append(blocks, webmElement(webmBlockGroup, webmElement(webmBlock, laced, bytes.Join(last, nil))))
+
+	file := bytes.Join([][]byte{
+		webmElement(webmEBML, webmElement(0x4282, []byte("webm"))),
+		webmElement(webmSegment,
+			webmElement(0x1549A966, []byte("info")),
+			webmElement(webmTracks,
+				webmElement(webmTrackEntry,
+					webmElement(webmTrackNumber, []byte{1}),
+					webmElement(webmCodecID, []byte("V_VP9")),
+				),
+				webmElement(webmTrackEntry,
+					webmElement(webmTrackNumber, []byte{2}),
+					webmElement(webmCodecID, []byte("A_OPUS")),
+					webmElement(webmCodecPrivate, head.Bytes()),
+				),
+			),
+			webmElement(webmCluster, append([][]byte{webmElement(0xE7, []byte{0})}, blocks...)...),
+		),
+	}, nil)
+
+	d, err := NewDemuxer(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAllFrames(t, d)
+	if len(got) != len(frames) {
+		t.Fatalf("Incorrect number of frames (got %d expected %d)", len(got), len(frames))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], frames[i]) {
+			t.Fatalf("frame %d is different", i)
+		}
+	}
+}
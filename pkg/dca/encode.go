@@ -3,6 +3,7 @@ package dca
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
@@ -11,14 +12,12 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
-	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/jonas747/ogg"
 )
 
 // AudioApplication is an application profile for opus encoding
@@ -32,8 +31,20 @@ var (
 
 var (
 	ErrBadFrame = errors.New("Bad Frame")
+	ErrKilled   = errors.New("Encoding was killed")
 )
 
+// ErrFFmpegExit is returned by OpusFrame when ffmpeg crashed,
+// Stderr has the last lines ffmpeg printed
+type ErrFFmpegExit struct {
+	Code   int
+	Stderr string
+}
+
+func (e ErrFFmpegExit) Error() string {
+	return fmt.Sprintf("ffmpeg exited with code %d: %s", e.Code, e.Stderr)
+}
+
 // EncodeOptions is a set of options for encoding dca
 type EncodeOptions struct {
 	Volume           int              // change audio volume (256=normal)
@@ -50,6 +61,9 @@ type EncodeOptions struct {
 	VBR              bool             // Wether vbr is used or not (variable bitrate)
 	Threads          int              // Number of threads to use, 0 for auto
 	StartTime        int              // Start Time of the input stream in seconds
+	Loudness         bool             // Measure the integrated loudness (EBU R128), see EncodeSession.Loudness
+	FrameIndex       bool             // Write a version 2 file ending in a frame index so it can be seeked, not with RawOutput
+	Transcoder       Transcoder       // What encodes the audio, DefaultTranscoder (ffmpeg) if nil
 
 	// The ffmpeg audio filters to use, see https://ffmpeg.org/ffmpeg-filters.html#Audio-Filters for more info
 	// Leave empty to use no filters.
@@ -122,6 +136,7 @@ type Frame struct {
 
 type EncodeSession struct {
 	sync.Mutex
+	ctx        context.Context
 	options    *EncodeOptions
 	pipeReader io.Reader
 	filePath   string
@@ -129,29 +144,41 @@ type EncodeSession struct {
 	running      bool
 	started      time.Time
 	frameChannel chan *Frame
-	process      *os.Process
+	transcoding  Transcoding
+	stopped      bool
 	lastStats    *EncodeStats
 
 	lastFrame int
 	err       error
 
+	// the frame index and byte offset of the next frame if FrameIndex is set
+	index  *FrameIndex
+	offset int64
+
 	ffmpegOutput string
 
 	// buffer that stores unread bytes (not full frames)
 	// used to implement io.Reader
 	buf bytes.Buffer
 
-	Killed bool
+	killed bool
 }
 
 // EncodedMem encodes data from memory
 func EncodeMem(r io.Reader, options *EncodeOptions) (session *EncodeSession, err error) {
+	return EncodeMemContext(context.Background(), r, options)
+}
+
+// EncodeMemContext encodes data from memory until ctx is done,
+// OpusFrame returns ErrKilled after that
+func EncodeMemContext(ctx context.Context, r io.Reader, options *EncodeOptions) (session *EncodeSession, err error) {
 	err = options.Validate()
 	if err != nil {
 		return
 	}
 
 	session = &EncodeSession{
+		ctx:          ctx,
 		options:      options,
 		pipeReader:   r,
 		frameChannel: make(chan *Frame, options.BufferedFrames),
@@ -162,12 +189,19 @@ func EncodeMem(r io.Reader, options *EncodeOptions) (session *EncodeSession, err
 
 // EncodeFile encodes the file/url/other in path
 func EncodeFile(path string, options *EncodeOptions) (session *EncodeSession, err error) {
+	return EncodeFileContext(context.Background(), path, options)
+}
+
+// EncodeFileContext encodes the file/url/other in path until ctx is done,
+// OpusFrame returns ErrKilled after that
+func EncodeFileContext(ctx context.Context, path string, options *EncodeOptions) (session *EncodeSession, err error) {
 	err = options.Validate()
 	if err != nil {
 		return
 	}
 
 	session = &EncodeSession{
+		ctx:          ctx,
 		options:      options,
 		filePath:     path,
 		frameChannel: make(chan *Frame, options.BufferedFrames),
@@ -187,165 +221,65 @@ func (e *EncodeSession) run() {
 	e.Lock()
 	e.running = true
 
-	inFile := "pipe:0"
-	if e.filePath != "" {
-		inFile = e.filePath
-	}
-
 	if e.options == nil {
 		e.options = StdEncodeOptions
 	}
 
-	vbrStr := "on"
-	if !e.options.VBR {
-		vbrStr = "off"
-	}
-
-	// Launch ffmpeg with a variety of different fruits and goodies mixed togheter
-	args := []string{
-		"-stats",
-		"-i", inFile,
-		"-reconnect", "1",
-		"-reconnect_at_eof", "1",
-		"-reconnect_streamed", "1",
-		"-reconnect_delay_max", "2",
-		"-map", "0:a",
-		"-acodec", "libopus",
-		"-f", "ogg",
-		"-vbr", vbrStr,
-		"-compression_level", strconv.Itoa(e.options.CompressionLevel),
-		"-vol", strconv.Itoa(e.options.Volume),
-		"-ar", strconv.Itoa(e.options.FrameRate),
-		"-ac", strconv.Itoa(e.options.Channels),
-		"-b:a", strconv.Itoa(e.options.Bitrate * 1000),
-		"-application", string(e.options.Application),
-		"-frame_duration", strconv.Itoa(e.options.FrameDuration),
-		"-packet_loss", strconv.Itoa(e.options.PacketLoss),
-		"-threads", strconv.Itoa(e.options.Threads),
-		"-ss", strconv.Itoa(e.options.StartTime),
-	}
-
-	if e.options.AudioFilter != "" {
-		// Lit af
-		args = append(args, "-af", e.options.AudioFilter)
-	}
-
-	args = append(args, "pipe:1")
-
-	ffmpeg := exec.Command("ffmpeg", args...)
-
-	logln(ffmpeg.Args)
-
-	if e.pipeReader != nil {
-		ffmpeg.Stdin = e.pipeReader
-	}
-
-	stdout, err := ffmpeg.StdoutPipe()
-	if err != nil {
-		e.Unlock()
-		logln("StdoutPipe Error:", err)
-		close(e.frameChannel)
-		return
-	}
-
-	stderr, err := ffmpeg.StderrPipe()
-	if err != nil {
-		e.Unlock()
-		logln("StderrPipe Error:", err)
-		close(e.frameChannel)
-		return
+	transcoder := e.options.Transcoder
+	if transcoder == nil {
+		transcoder = DefaultTranscoder
 	}
 
 	if !e.options.RawOutput {
 		e.writeMetadataFrame()
 	}
 
-	// Starts the ffmpeg command
-	err = ffmpeg.Start()
+	// the transcoder stops when the context is done
+	transcoding, err := transcoder.Transcode(e.ctx, TranscodeInput{Path: e.filePath, Reader: e.pipeReader}, e.options)
 	if err != nil {
+		e.err = err
 		e.Unlock()
-		logln("RunStart Error:", err)
+		logln("Transcode Error:", err)
 		close(e.frameChannel)
 		return
 	}
 
 	e.started = time.Now()
 
-	e.process = ffmpeg.Process
+	e.transcoding = transcoding
 	e.Unlock()
 
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go e.readStderr(stderr, &wg)
+	if messages := transcoding.Messages(); messages != nil {
+		wg.Add(1)
+		go e.readStderr(messages, &wg)
+	}
 
 	defer close(e.frameChannel)
-	e.readStdout(stdout)
+	e.readPackets(transcoding)
 	wg.Wait()
-	err = ffmpeg.Wait()
+	err = transcoding.Wait()
 	if err != nil {
-		if err.Error() != "signal: killed" {
-			e.Lock()
+		e.Lock()
+		// Stop kills the transcoder too
+		if !e.killed && !e.stopped && e.ctx.Err() == nil {
 			e.err = err
-			e.Unlock()
 		}
+		e.Unlock()
 	}
 }
 
 func (e *EncodeSession) writeMetadataFrame() {
 	// Setup the metadata
-	metadata := Metadata{
-		Dca: &DCAMetadata{
-			Version: FormatVersion,
-			Tool: &DCAToolMetadata{
-				Name:    "dca",
-				Version: LibraryVersion,
-				Url:     GitHubRepositoryURL,
-				Author:  "jonas747",
-			},
-		},
-		Opus: &OpusMetadata{
-			Bitrate:     e.options.Bitrate * 1000,
-			SampleRate:  e.options.FrameRate,
-			Application: string(e.options.Application),
-			FrameSize:   e.options.PCMFrameLen(),
-			Channels:    e.options.Channels,
-			VBR:         e.options.VBR,
-		},
-		SongInfo: &SongMetadata{},
-		Origin:   &OriginMetadata{},
-		Extra:    &ExtraMetadata{},
-	}
+	metadata := NewMetadata(e.options)
 	var cmdBuf bytes.Buffer
 	// get ffprobe data
 	if e.pipeReader == nil {
-		ffprobe := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", e.filePath)
-		ffprobe.Stdout = &cmdBuf
-
-		err := ffprobe.Start()
-		if err != nil {
-			logln("RunStart Error:", err)
-			return
-		}
-
-		err = ffprobe.Wait()
+		ffprobeData, err := Probe(e.filePath)
 		if err != nil {
 			logln("FFprobe Error:", err)
 			return
 		}
-		var ffprobeData *FFprobeMetadata
-		err = json.Unmarshal(cmdBuf.Bytes(), &ffprobeData)
-		if err != nil {
-			logln("Erorr unmarshaling the FFprobe JSON:", err)
-			return
-		}
-
-		if ffprobeData.Format == nil {
-			ffprobeData.Format = &FFprobeFormat{}
-		}
-
-		if ffprobeData.Format.Tags == nil {
-			ffprobeData.Format.Tags = &FFprobeTags{}
-		}
 
 		bitrateInt, err := strconv.Atoi(ffprobeData.Format.Bitrate)
 		if err != nil {
@@ -408,28 +342,70 @@ func (e *EncodeSession) writeMetadataFrame() {
 		}
 	}
 
+	if e.options.FrameIndex {
+		metadata.Dca.Version = IndexedFormatVersion
+	}
+
 	// Write the magic header
-	jsonData, err := json.Marshal(metadata)
+	var buf bytes.Buffer
+	err := writeHeader(&buf, metadata)
 	if err != nil {
-		logln("JSon error:", err)
+		logln("Couldn't write metadata:", err)
 		return
 	}
-	var buf bytes.Buffer
-	buf.Write([]byte(fmt.Sprintf("DCA%d", FormatVersion)))
 
-	// Write the actual json data and length
-	jsonLen := int32(len(jsonData))
-	err = binary.Write(&buf, binary.LittleEndian, &jsonLen)
-	if err != nil {
-		logln("Couldn't write json len:", err)
-		return
+	if e.options.FrameIndex {
+		e.index = newFrameIndex()
+		e.offset = int64(buf.Len())
 	}
 
-	buf.Write(jsonData)
 	e.frameChannel <- &Frame{buf.Bytes(), true}
 }
 
-func (e *EncodeSession) readStderr(stderr io.ReadCloser, wg *sync.WaitGroup) {
+// Probe runs ffprobe on the file/url/other in path and returns the format information.
+// Format and Format.Tags are never nil on success.
+func Probe(path string) (*FFprobeMetadata, error) {
+	var cmdBuf bytes.Buffer
+	ffprobe := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", path)
+	ffprobe.Stdout = &cmdBuf
+
+	err := ffprobe.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	var ffprobeData *FFprobeMetadata
+	err = json.Unmarshal(cmdBuf.Bytes(), &ffprobeData)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling the FFprobe JSON: %w", err)
+	}
+
+	if ffprobeData == nil {
+		ffprobeData = &FFprobeMetadata{}
+	}
+
+	if ffprobeData.Format == nil {
+		ffprobeData.Format = &FFprobeFormat{}
+	}
+
+	if ffprobeData.Format.Tags == nil {
+		ffprobeData.Format.Tags = &FFprobeTags{}
+	}
+
+	return ffprobeData, nil
+}
+
+// ParsedDuration returns the duration ffprobe reported, 0 if unknown (eg. a live stream)
+func (f *FFprobeFormat) ParsedDuration() time.Duration {
+	seconds, err := strconv.ParseFloat(f.Duration, 64)
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (e *EncodeSession) readStderr(stderr io.Reader, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	bufReader := bufio.NewReader(stderr)
@@ -452,7 +428,8 @@ func (e *EncodeSession) readStderr(stderr io.ReadCloser, wg *sync.WaitGroup) {
 				outBuf.Reset()
 			}
 		case '\n':
-			// Message
+			// Message, ffmpeg ends the last stats line with a newline
+			e.handleStderrLine(outBuf.String())
 			e.Lock()
 			e.ffmpegOutput += outBuf.String() + "\n"
 			e.Unlock()
@@ -463,34 +440,35 @@ func (e *EncodeSession) readStderr(stderr io.ReadCloser, wg *sync.WaitGroup) {
 	}
 }
 
+// statsField matches the key=value pairs in a ffmpeg stats line, ffmpeg pads the values with spaces
+var statsField = regexp.MustCompile(`(\w+)=\s*(\S+)`)
+
 func (e *EncodeSession) handleStderrLine(line string) {
 	if strings.Index(line, "size=") != 0 {
 		return // Not stats info
 	}
 
-	var size int
-
-	var timeH int
-	var timeM int
-	var timeS float32
-
-	var bitrate float32
-	var speed float32
-
-	_, err := fmt.Sscanf(line, "size=%dkB time=%d:%d:%f bitrate=%fkbits/s speed=%fx", &size, &timeH, &timeM, &timeS, &bitrate, &speed)
-	if err != nil {
-		logln("Error parsing ffmpeg stats:", err)
-	}
-
-	dur := time.Duration(timeH) * time.Hour
-	dur += time.Duration(timeM) * time.Minute
-	dur += time.Duration(timeS) * time.Second
-
-	stats := &EncodeStats{
-		Size:     size,
-		Duration: dur,
-		Bitrate:  bitrate,
-		Speed:    speed,
+	stats := &EncodeStats{}
+	for _, field := range statsField.FindAllStringSubmatch(line, -1) {
+		value := field[2]
+		switch field[1] {
+		case "size":
+			// older versions print kB, newer KiB
+			fmt.Sscanf(strings.TrimRight(value, "iBkK"), "%d", &stats.Size)
+		case "time":
+			var timeH, timeM int
+			var timeS float64
+			_, err := fmt.Sscanf(value, "%d:%d:%f", &timeH, &timeM, &timeS)
+			if err != nil {
+				logln("Error parsing ffmpeg stats:", err)
+				continue
+			}
+			stats.Duration = time.Duration(timeH)*time.Hour + time.Duration(timeM)*time.Minute + time.Duration(timeS*float64(time.Second))
+		case "bitrate":
+			fmt.Sscanf(strings.TrimSuffix(value, "kbits/s"), "%f", &stats.Bitrate)
+		case "speed":
+			fmt.Sscanf(strings.TrimSuffix(value, "x"), "%f", &stats.Speed)
+		}
 	}
 
 	e.Lock()
@@ -498,31 +476,39 @@ func (e *EncodeSession) handleStderrLine(line string) {
 	e.Unlock()
 }
 
-func (e *EncodeSession) readStdout(stdout io.ReadCloser) {
-	decoder := ogg.NewPacketDecoder(ogg.NewDecoder(stdout))
-
-	// the first 2 packets are ogg opus metadata
-	skipPackets := 2
+func (e *EncodeSession) readPackets(transcoding Transcoding) {
 	for {
-		// Retrieve a packet
-		packet, _, err := decoder.Decode()
-		if skipPackets > 0 {
-			skipPackets--
-			continue
-		}
+		packet, err := transcoding.ReadPacket()
 		if err != nil {
 			if err != io.EOF {
-				logln("Error reading ffmpeg stdout:", err)
+				logln("Error reading opus packet:", err)
 			}
 			break
 		}
 
 		err = e.writeOpusFrame(packet)
+		if err == ErrKilled {
+			return
+		}
 		if err != nil {
 			logln("Error writing opus frame:", err)
 			break
 		}
 	}
+
+	if e.index != nil {
+		var buf bytes.Buffer
+		err := e.index.writeTo(&buf)
+		if err != nil {
+			logln("Error writing frame index:", err)
+			return
+		}
+		// only Read returns it, like the metadata
+		select {
+		case e.frameChannel <- &Frame{buf.Bytes(), true}:
+		case <-e.ctx.Done():
+		}
+	}
 }
 
 func (e *EncodeSession) writeOpusFrame(opusFrame []byte) error {
@@ -538,7 +524,17 @@ func (e *EncodeSession) writeOpusFrame(opusFrame []byte) error {
 		return err
 	}
 
-	e.frameChannel <- &Frame{dcaBuf.Bytes(), false}
+	if e.index != nil {
+		e.index.add(e.index.Frames, e.offset)
+		e.offset += int64(dcaBuf.Len())
+	}
+
+	select {
+	case e.frameChannel <- &Frame{dcaBuf.Bytes(), false}:
+	case <-e.ctx.Done():
+		// nobody is going to read it
+		return ErrKilled
+	}
 
 	e.Lock()
 	e.lastFrame++
@@ -551,12 +547,12 @@ func (e *EncodeSession) writeOpusFrame(opusFrame []byte) error {
 func (e *EncodeSession) Stop() error {
 	e.Lock()
 	defer e.Unlock()
-	if !e.running || e.process == nil {
+	if !e.running || e.transcoding == nil {
 		return errors.New("Not running")
 	}
 
-	err := e.process.Kill()
-	return err
+	e.stopped = true
+	return e.transcoding.Kill()
 }
 
 // ReadFrame blocks until a frame is read or there are no more frames
@@ -564,17 +560,19 @@ func (e *EncodeSession) Stop() error {
 func (e *EncodeSession) ReadFrame() (frame []byte, err error) {
 	f := <-e.frameChannel
 	if f == nil {
-		return nil, io.EOF
+		return nil, e.endError()
 	}
 
 	return f.data, nil
 }
 
-// OpusFrame implements OpusReader, returning the next opus frame
+// OpusFrame implements OpusReader, returning the next opus frame.
+// After the last frame it returns io.EOF, ErrKilled if the session was killed
+// or ErrFFmpegExit if ffmpeg crashed.
 func (e *EncodeSession) OpusFrame() (frame []byte, err error) {
 	f := <-e.frameChannel
 	if f == nil {
-		return nil, io.EOF
+		return nil, e.endError()
 	}
 
 	if f.metaData {
@@ -622,12 +620,53 @@ func (e *EncodeSession) Truncate() {
 	e.Cleanup()
 }
 
+// endError is why there are no more frames
+func (e *EncodeSession) endError() error {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.killed || e.ctx.Err() != nil {
+		return ErrKilled
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(e.err, &exitErr) {
+		return ErrFFmpegExit{
+			Code:   exitErr.ExitCode(),
+			Stderr: lastLines(e.ffmpegOutput, 5),
+		}
+	}
+	if e.err != nil {
+		return e.err
+	}
+
+	return io.EOF
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
 // Kill runs Cleanup as well as setting a kill flag
 func (e *EncodeSession) Kill() {
-	e.Killed = true
+	e.Lock()
+	e.killed = true
+	e.Unlock()
 	e.Cleanup()
 }
 
+// Killed returns true if the session was killed or its context is done
+func (e *EncodeSession) Killed() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.killed || e.ctx.Err() != nil
+}
+
 // Cleanup cleans up the encoding session, throwring away all unread frames and stopping ffmpeg
 // ensuring that no ffmpeg processes starts piling up on your system
 // You should always call this after it's done
@@ -670,6 +709,27 @@ func (e *EncodeSession) Error() error {
 	return e.err
 }
 
+// Loudness returns the integrated loudness in LUFS measured by ffmpeg,
+// ok is false if the Loudness option was not set or ffmpeg has not finished yet
+func (e *EncodeSession) Loudness() (lufs float64, ok bool) {
+	output := e.FFMPEGMessages()
+
+	// the ebur128 summary looks like
+	//   Integrated loudness:
+	//     I:         -14.2 LUFS
+	i := strings.LastIndex(output, "Integrated loudness:")
+	if i < 0 {
+		return 0, false
+	}
+
+	_, err := fmt.Sscanf(strings.TrimSpace(output[i+len("Integrated loudness:"):]), "I: %f LUFS", &lufs)
+	if err != nil {
+		return 0, false
+	}
+
+	return lufs, true
+}
+
 // FFMPEGMessages returns messages printed by ffmpeg to stderr, you can use this to see what ffmpeg is saying if your encoding fails
 func (e *EncodeSession) FFMPEGMessages() string {
 	e.Lock()
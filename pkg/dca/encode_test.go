@@ -1,11 +1,23 @@
 package dca
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncode(t *testing.T) {
-	session, err := EncodeFile("testaudio.ogg", StdEncodeOptions)
+	options := *StdEncodeOptions
+	// what ffmpeg makes of testaudio.ogg
+	options.Transcoder = &FakeTranscoder{Frames: 756}
+
+	session, err := EncodeFile("testaudio.ogg", &options)
 	if err != nil {
 		t.Fatal("Failed creating encoding session", err)
 	}
@@ -19,9 +31,124 @@ func TestEncode(t *testing.T) {
 		numFrames++
 	}
 
-	// Predermined, probably gonna change the testing method somehow
 	if numFrames != 756 {
 		t.Errorf("Incorrect number of frames (got %d expected %d)", numFrames, 756)
 		t.Fail()
 	}
 }
+
+func TestLoudness(t *testing.T) {
+	session := &EncodeSession{
+		ffmpegOutput: "[Parsed_ebur128_0 @ 0x5581] Summary:\n\n  Integrated loudness:\n    I:         -14.2 LUFS\n    Threshold: -24.6 LUFS\n\n  Loudness range:\n    LRA:         5.1 LU\n",
+	}
+
+	lufs, ok := session.Loudness()
+	if !ok {
+		t.Fatal("Loudness not found")
+	}
+	if lufs != -14.2 {
+		t.Errorf("Incorrect loudness (got %f expected %f)", lufs, -14.2)
+	}
+
+	_, ok = (&EncodeSession{}).Loudness()
+	if ok {
+		t.Error("Found loudness without ebur128 output")
+	}
+}
+
+func TestStderrStats(t *testing.T) {
+	lines := []string{
+		"size=     512kB time=00:01:05.50 bitrate=  64.0kbits/s speed=12.3x",
+		"size=     512KiB time=00:01:05.50 bitrate=  64.0kbits/s speed=12.3x    ",
+	}
+
+	for _, line := range lines {
+		session := &EncodeSession{}
+		session.handleStderrLine(line)
+
+		stats := session.Stats()
+		if stats.Size != 512 {
+			t.Errorf("Incorrect size for %q (got %d expected %d)", line, stats.Size, 512)
+		}
+		if stats.Duration != 65500*time.Millisecond {
+			t.Errorf("Incorrect duration for %q (got %s expected %s)", line, stats.Duration, 65500*time.Millisecond)
+		}
+		if stats.Speed != 12.3 {
+			t.Errorf("Incorrect speed for %q (got %f expected %f)", line, stats.Speed, 12.3)
+		}
+	}
+}
+
+// fakeFFmpeg puts a script named ffmpeg first in the PATH
+func fakeFFmpeg(t *testing.T, script string) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+	})
+}
+
+func TestEncodeErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+
+	t.Run("crash", func(t *testing.T) {
+		fakeFFmpeg(t, "cat > /dev/null\necho 'pipe:0: Invalid data found when processing input' >&2\nexit 1\n")
+
+		session, err := EncodeMem(strings.NewReader("not audio"), StdEncodeOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = session.OpusFrame()
+		var exitErr ErrFFmpegExit
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("expected ErrFFmpegExit, got %v", err)
+		}
+		if exitErr.Code != 1 || !strings.Contains(exitErr.Stderr, "Invalid data") {
+			t.Errorf("unexpected exit error %+v", exitErr)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		fakeFFmpeg(t, "exec sleep 10\n")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		session, err := EncodeMemContext(ctx, strings.NewReader(""), StdEncodeOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.AfterFunc(100*time.Millisecond, cancel)
+		_, err = session.OpusFrame()
+		if err != ErrKilled {
+			t.Errorf("expected ErrKilled, got %v", err)
+		}
+		if !session.Killed() {
+			t.Error("expected the session to be killed")
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		fakeFFmpeg(t, "exec sleep 10\n")
+
+		session, err := EncodeMem(strings.NewReader(""), StdEncodeOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		session.Kill()
+		_, err = session.OpusFrame()
+		if err != ErrKilled {
+			t.Errorf("expected ErrKilled, got %v", err)
+		}
+	})
+}
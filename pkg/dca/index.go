@@ -0,0 +1,121 @@
+package dca
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Version 2 dca files are version 1 files that can end with a frame index:
+//
+//	int16   -1, where the next frame size would be
+//	uint32  interval, number of frames between index entries
+//	uint32  total number of frames
+//	uint32  number of index entries
+//	int64[] byte offset of every interval'th frame, from the start of the file
+//	uint32  size of the index, from the -1 up to and including the "DCAI" after it
+//	"DCAI"
+//
+// Version 1 readers stop at the -1 with ErrNegativeFrameSize.
+const (
+	// IndexedFormatVersion is the version of dca files with a frame index
+	IndexedFormatVersion int8 = 2
+
+	// IndexInterval is the number of frames between index entries, a second of 20ms frames
+	IndexInterval = 50
+)
+
+var (
+	ErrBadIndex    = errors.New("Corrupt dca frame index")
+	ErrNotSeekable = errors.New("Can only seek forward, the reader is not seekable")
+)
+
+// indexMarker is the frame size that starts the index
+const indexMarker int16 = -1
+
+// FrameIndex has the byte offset of every Interval'th frame in a dca file
+type FrameIndex struct {
+	Interval int
+	Frames   int
+	Offsets  []int64
+}
+
+func newFrameIndex() *FrameIndex {
+	return &FrameIndex{Interval: IndexInterval}
+}
+
+// add keeps the offset of a frame if it is the next one we need
+func (i *FrameIndex) add(frame int, offset int64) {
+	if frame%i.Interval == 0 && frame/i.Interval == len(i.Offsets) {
+		i.Offsets = append(i.Offsets, offset)
+	}
+	if frame >= i.Frames {
+		i.Frames = frame + 1
+	}
+}
+
+// writeTo writes the index as it goes at the end of a dca file
+func (i *FrameIndex) writeTo(w io.Writer) error {
+	header := struct {
+		Marker   int16
+		Interval uint32
+		Frames   uint32
+		Count    uint32
+	}{indexMarker, uint32(i.Interval), uint32(i.Frames), uint32(len(i.Offsets))}
+
+	err := binary.Write(w, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, i.Offsets)
+	if err != nil {
+		return err
+	}
+
+	size := uint32(binary.Size(header) + 8*len(i.Offsets) + 8)
+	err = binary.Write(w, binary.LittleEndian, size)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("DCAI"))
+	return err
+}
+
+// readFrameIndex reads an index after its -1 marker
+func readFrameIndex(r io.Reader) (*FrameIndex, error) {
+	var header struct {
+		Interval uint32
+		Frames   uint32
+		Count    uint32
+	}
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Interval == 0 || header.Count > header.Frames/header.Interval+1 {
+		return nil, ErrBadIndex
+	}
+
+	index := &FrameIndex{
+		Interval: int(header.Interval),
+		Frames:   int(header.Frames),
+		Offsets:  make([]int64, header.Count),
+	}
+	err = binary.Read(r, binary.LittleEndian, index.Offsets)
+	if err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, 8)
+	_, err = io.ReadFull(r, trailer)
+	if err != nil {
+		return nil, err
+	}
+	if string(trailer[4:]) != "DCAI" {
+		return nil, ErrBadIndex
+	}
+
+	return index, nil
+}
@@ -0,0 +1,218 @@
+package dca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMixing     = errors.New("Already mixing a clip")
+	ErrClipLength = errors.New("Clip has no length")
+)
+
+// mixFilter ducks the music (input 0) while the clip (input 1) plays over it.
+// amix halves both inputs, the volume filter undoes that.
+const mixFilter = "[1:a]aformat=sample_rates=%d:channel_layouts=%s,asplit=2[clip][key];" +
+	"[0:a][key]sidechaincompress=threshold=0.02:ratio=8:attack=10:release=300[music];" +
+	"[music][clip]amix=inputs=2:duration=first:dropout_transition=0,volume=2[out]"
+
+// Mixer is an OpusReader that plays clips over the frames of another OpusReader.
+// The frames the clip plays over are decoded, mixed and encoded again by ffmpeg,
+// the others are passed through.
+type Mixer struct {
+	sync.Mutex
+	ctx     context.Context
+	source  OpusReader
+	options EncodeOptions
+
+	// reading makes sure only one goroutine reads the source
+	reading sync.Mutex
+	// pending are frames that are read again before the source
+	pending [][]byte
+	mix     *mixing
+}
+
+// mixing is a clip being mixed
+type mixing struct {
+	session *EncodeSession
+	input   *io.PipeReader
+	fed     chan error // the error that ended the source while feeding the mix, or nil
+}
+
+// NewMixer creates a Mixer reading from source, clips are encoded with options until ctx is done.
+// Setting Transcoder in the options replaces ffmpeg.
+func NewMixer(ctx context.Context, source OpusReader, options *EncodeOptions) *Mixer {
+	m := &Mixer{
+		ctx:     ctx,
+		source:  source,
+		options: *options,
+	}
+	// the music already has its volume and start time
+	m.options.Volume = 256
+	m.options.StartTime = 0
+	m.options.AudioFilter = ""
+	m.options.RawOutput = true
+	m.options.Loudness = false
+	m.options.FrameIndex = false
+
+	return m
+}
+
+// mixArgs returns the ffmpeg arguments to mix clip over Ogg Opus from stdin
+func mixArgs(clip string) func(input TranscodeInput, options *EncodeOptions) []string {
+	return func(input TranscodeInput, options *EncodeOptions) []string {
+		layout := "stereo"
+		if options.Channels == 1 {
+			layout = "mono"
+		}
+
+		args := []string{
+			"-stats",
+			"-f", "ogg", "-i", "pipe:0",
+			"-i", clip,
+			"-filter_complex", fmt.Sprintf(mixFilter, options.FrameRate, layout),
+			"-map", "[out]",
+		}
+		args = append(args, ffmpegOpusArgs(options)...)
+		return append(args, "pipe:1")
+	}
+}
+
+// Play mixes the clip (file/url/other) over the next frames, length is how long the clip is.
+// It returns ErrMixing if another clip is still playing.
+func (m *Mixer) Play(clip string, length time.Duration) error {
+	frames := int((length + m.source.FrameDuration() - 1) / m.source.FrameDuration())
+	if frames <= 0 {
+		return ErrClipLength
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.mix != nil {
+		return ErrMixing
+	}
+
+	options := m.options
+	if options.Transcoder == nil {
+		options.Transcoder = &CommandTranscoder{
+			Command: "ffmpeg",
+			Args:    mixArgs(clip),
+		}
+	}
+
+	input, output := io.Pipe()
+	session, err := EncodeMemContext(m.ctx, input, &options)
+	if err != nil {
+		return err
+	}
+
+	mix := &mixing{
+		session: session,
+		input:   input,
+		fed:     make(chan error, 1),
+	}
+	go m.feed(output, frames, mix.fed)
+	m.mix = mix
+
+	return nil
+}
+
+// feed writes the music the clip plays over to the mix as Ogg Opus
+func (m *Mixer) feed(w *io.PipeWriter, frames int, fed chan error) {
+	defer w.Close()
+
+	o, err := NewOggWriter(w, m.options.Channels)
+	if err != nil {
+		// the mix ended before it wanted the music
+		fed <- nil
+		return
+	}
+
+	for i := 0; i < frames; i++ {
+		m.reading.Lock()
+		frame, err := m.read()
+		m.reading.Unlock()
+		if err != nil {
+			o.Close()
+			fed <- err
+			return
+		}
+
+		err = o.WriteFrame(frame)
+		if err != nil {
+			fed <- nil
+			return
+		}
+	}
+
+	o.Close()
+	fed <- nil
+}
+
+// Mixing returns true while a clip is playing
+func (m *Mixer) Mixing() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.mix != nil
+}
+
+// OpusFrame implements OpusReader, returning the next frame of the source or the mix
+func (m *Mixer) OpusFrame() ([]byte, error) {
+	m.Lock()
+	mix := m.mix
+	m.Unlock()
+
+	if mix != nil {
+		frame, err := mix.session.OpusFrame()
+		if err == nil {
+			return frame, nil
+		}
+
+		// the clip is over, stop feeding it music if it ended early
+		mix.input.CloseWithError(io.ErrClosedPipe)
+		sourceErr := <-mix.fed
+		mix.session.Cleanup()
+
+		m.Lock()
+		m.mix = nil
+		m.Unlock()
+
+		if err != io.EOF && err != ErrKilled {
+			logln("Mixing failed:", err)
+		}
+		if sourceErr != nil {
+			return nil, sourceErr
+		}
+	}
+
+	m.reading.Lock()
+	defer m.reading.Unlock()
+	return m.read()
+}
+
+// read returns the next frame of the music, m.reading must be held
+func (m *Mixer) read() ([]byte, error) {
+	if len(m.pending) > 0 {
+		frame := m.pending[0]
+		m.pending = m.pending[1:]
+		return frame, nil
+	}
+	return m.source.OpusFrame()
+}
+
+// Unread puts frames back in front of the source, like the frames a stream read ahead,
+// so a clip played next is mixed over them
+func (m *Mixer) Unread(frames [][]byte) {
+	m.reading.Lock()
+	m.pending = append(frames[:len(frames):len(frames)], m.pending...)
+	m.reading.Unlock()
+}
+
+// FrameDuration implements OpusReader
+func (m *Mixer) FrameDuration() time.Duration {
+	return m.source.FrameDuration()
+}
@@ -0,0 +1,61 @@
+package dca
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMixer(t *testing.T) {
+	music := [][]byte{}
+	for i := 0; i < 20; i++ {
+		music = append(music, []byte{0xFC, byte(i)})
+	}
+
+	options := *StdEncodeOptions
+	options.Transcoder = &FakeTranscoder{Frames: 5}
+	mixer := NewMixer(context.Background(), &sliceReader{music}, &options)
+
+	expect := func(want []byte) {
+		t.Helper()
+		frame, err := mixer.OpusFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("expected frame %x, got %x", want, frame)
+		}
+	}
+
+	expect(music[0])
+	expect(music[1])
+
+	err := mixer.Play("airhorn.ogg", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mixer.Play("rimshot.ogg", time.Second); err != ErrMixing {
+		t.Errorf("expected ErrMixing, got %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		expect(FakeFrame(i))
+	}
+
+	// the fake never reads the music, so none of it was skipped
+	expect(music[2])
+
+	// frames a stream read ahead come back before the rest of the music
+	mixer.Unread([][]byte{music[1], music[2]})
+	expect(music[1])
+	expect(music[2])
+	expect(music[3])
+	if mixer.Mixing() {
+		t.Error("expected the mix to be over")
+	}
+
+	if err := mixer.Play("silence.ogg", 0); err != ErrClipLength {
+		t.Errorf("expected ErrClipLength, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package dca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+)
+
+var (
+	ErrBadOpusPacket = errors.New("Opus packet is too short")
+)
+
+// OggWriter writes opus frames in an Ogg Opus container (RFC 7845)
+type OggWriter struct {
+	w       io.Writer
+	serial  uint32
+	page    uint32
+	granule int64
+
+	// the last frame is held back so its page can be marked as the end of the stream
+	pending []byte
+}
+
+// NewOggWriter writes the Ogg Opus headers to w,
+// comments are added as "KEY=value" Vorbis comments
+func NewOggWriter(w io.Writer, channels int, comments ...string) (*OggWriter, error) {
+	o := &OggWriter{
+		w:      w,
+		serial: rand.Uint32(),
+	}
+
+	var head bytes.Buffer
+	head.WriteString("OpusHead")
+	binary.Write(&head, binary.LittleEndian, struct {
+		Version         uint8
+		Channels        uint8
+		PreSkip         uint16
+		InputSampleRate uint32
+		OutputGain      int16
+		MappingFamily   uint8
+	}{1, uint8(channels), 0, 48000, 0, 0})
+
+	err := o.writePage(oggBOS, 0, head.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var tags bytes.Buffer
+	tags.WriteString("OpusTags")
+	vendor := "dca " + LibraryVersion
+	binary.Write(&tags, binary.LittleEndian, uint32(len(vendor)))
+	tags.WriteString(vendor)
+	binary.Write(&tags, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		binary.Write(&tags, binary.LittleEndian, uint32(len(c)))
+		tags.WriteString(c)
+	}
+
+	err = o.writePage(0, 0, tags.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// WriteFrame writes a single opus frame
+func (o *OggWriter) WriteFrame(frame []byte) error {
+	_, err := opusSamples(frame)
+	if err != nil {
+		return err
+	}
+
+	if o.pending != nil {
+		err = o.writeFrame(0, o.pending)
+		if err != nil {
+			return err
+		}
+	}
+	o.pending = append(o.pending[:0], frame...)
+	return nil
+}
+
+// Close ends the Ogg stream, it does not close the underlying writer
+func (o *OggWriter) Close() error {
+	if o.pending == nil {
+		// an empty stream still needs an end
+		return o.writePage(oggEOS, 0, nil)
+	}
+	return o.writeFrame(oggEOS, o.pending)
+}
+
+func (o *OggWriter) writeFrame(flags byte, frame []byte) error {
+	samples, _ := opusSamples(frame)
+	// the granule position is the number of samples at the end of the page
+	o.granule += int64(samples)
+	return o.writePage(flags, o.granule, frame)
+}
+
+// Ogg page flags
+const (
+	oggBOS = 2
+	oggEOS = 4
+)
+
+// writePage writes a page with a single packet, opus packets always fit in one
+func (o *OggWriter) writePage(flags byte, granule int64, packet []byte) error {
+	if len(packet) >= 255*255 {
+		return ErrBadOpusPacket
+	}
+
+	var page bytes.Buffer
+	page.WriteString("OggS")
+	binary.Write(&page, binary.LittleEndian, struct {
+		Version  uint8
+		Flags    uint8
+		Granule  int64
+		Serial   uint32
+		Sequence uint32
+		Checksum uint32
+		Segments uint8
+	}{0, flags, granule, o.serial, o.page, 0, uint8(len(packet)/255 + 1)})
+
+	// a packet ends with the first segment shorter than 255 bytes
+	for i := 0; i < len(packet)/255; i++ {
+		page.WriteByte(255)
+	}
+	page.WriteByte(byte(len(packet) % 255))
+	page.Write(packet)
+
+	b := page.Bytes()
+	binary.LittleEndian.PutUint32(b[22:26], oggChecksum(b))
+	o.page++
+
+	_, err := o.w.Write(b)
+	return err
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}()
+
+// oggChecksum is the CRC-32 of a page with its checksum set to 0
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// VorbisComments returns the song info as comments for NewOggWriter,
+// the cover is added as a METADATA_BLOCK_PICTURE like FLAC does
+func (m *SongMetadata) VorbisComments() []string {
+	comments := []string{}
+	for _, c := range []struct{ key, value string }{
+		{"TITLE", m.Title},
+		{"ARTIST", m.Artist},
+		{"ALBUM", m.Album},
+		{"GENRE", m.Genre},
+		{"COMMENT", m.Comments},
+	} {
+		if c.value != "" {
+			comments = append(comments, c.key+"="+c.value)
+		}
+	}
+
+	if m.Cover == nil || *m.Cover == "" {
+		return comments
+	}
+	cover, err := base64.StdEncoding.DecodeString(*m.Cover)
+	if err != nil {
+		return comments
+	}
+
+	mime := "image/jpeg"
+	if bytes.HasPrefix(cover, []byte("\x89PNG")) {
+		mime = "image/png"
+	}
+
+	// type, mime type, description, width, height, depth, colors and the picture, we only know some
+	var picture bytes.Buffer
+	binary.Write(&picture, binary.BigEndian, uint32(3)) // front cover
+	binary.Write(&picture, binary.BigEndian, uint32(len(mime)))
+	picture.WriteString(mime)
+	binary.Write(&picture, binary.BigEndian, [5]uint32{})
+	binary.Write(&picture, binary.BigEndian, uint32(len(cover)))
+	picture.Write(cover)
+
+	return append(comments, "METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(picture.Bytes()))
+}
+
+// OggReader returns the frames of r as an Ogg Opus stream, so they can be fed to ffmpeg again.
+// Closing it stops reading from r.
+func OggReader(r OpusReader, channels int) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		o, err := NewOggWriter(pw, channels)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		for {
+			frame, err := r.OpusFrame()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			err = o.WriteFrame(frame)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		pw.CloseWithError(o.Close())
+	}()
+
+	return pr
+}
+
+// opusSamples returns the number of 48kHz samples in an opus packet, see RFC 6716 section 3.1
+func opusSamples(packet []byte) (int, error) {
+	if len(packet) < 1 {
+		return 0, ErrBadOpusPacket
+	}
+
+	// frame size in 48kHz samples of every TOC config
+	config := packet[0] >> 3
+	var frameSize int
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60ms
+		frameSize = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10 or 20ms
+		frameSize = []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10 or 20ms
+		frameSize = []int{120, 240, 480, 960}[config%4]
+	}
+
+	frames := 1
+	switch packet[0] & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, ErrBadOpusPacket
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	return frames * frameSize, nil
+}
@@ -2,16 +2,65 @@ package dca
 
 import (
 	"errors"
-	"github.com/bwmarrin/discordgo"
 	"io"
 	"sync"
 	"time"
+
+	"github.com/bwmarrin/discordgo"
 )
 
 var (
 	ErrVoiceConnClosed = errors.New("Voice connection closed")
+	ErrStreamStopped   = errors.New("Stream was stopped")
 )
 
+// SilenceFrame is an opus frame of silence, discord wants a few of them
+// when the audio stops so it doesn't interpolate garbage
+var SilenceFrame = []byte{0xF8, 0xFF, 0xFE}
+
+// silenceFrames is how many silence frames are sent after a pause or stop
+const silenceFrames = 5
+
+// FrameHook is called after every frame sent to discord with the playback position after it
+type FrameHook func(frame []byte, position time.Duration)
+
+// StreamOptions is a set of options for streaming to discord
+type StreamOptions struct {
+	PreRoll     int           // frames buffered before playing starts and after an underrun
+	BufferSize  int           // most frames read ahead of playback, at least PreRoll
+	SendTimeout time.Duration // how long discord may not take a frame before ErrVoiceConnClosed
+	CatchUp     bool          // skip the frames that should have played during an underrun instead of playing them late, for live streams
+}
+
+// StdStreamOptions is the standard options for streaming
+var StdStreamOptions = &StreamOptions{
+	PreRoll:     25,  // At 20ms frames that's 0.5s
+	BufferSize:  150, // and 3s
+	SendTimeout: time.Second,
+}
+
+// StreamStats is how well the source keeps up with playback
+type StreamStats struct {
+	Buffered   int           // frames read ahead
+	Underruns  int           // times the buffer ran dry for longer than a frame while playing
+	LateFrames int           // frames that were not buffered in time, but came in before the last one finished playing
+	Dropped    int           // frames skipped to catch up after an underrun
+	Stalled    time.Duration // total time spent waiting after underruns
+}
+
+// bufferedFrame is a frame read ahead, or the error that ended the source
+type bufferedFrame struct {
+	data     []byte
+	duration time.Duration
+	err      error
+}
+
+// flushRequest is a Flush waiting for the reader
+type flushRequest struct {
+	unread func(frames [][]byte)
+	done   chan bool
+}
+
 // StreamingSession provides an easy way to directly transmit opus audio
 // to discord from an encode session.
 type StreamingSession struct {
@@ -20,11 +69,34 @@ type StreamingSession struct {
 	// If this channel is not nil, an error will be sen when finished (or nil if no error)
 	done chan error
 
-	source OpusReader
-	vc     *discordgo.VoiceConnection
-
-	paused     bool
-	framesSent int
+	source  OpusReader
+	vc      *discordgo.VoiceConnection
+	options StreamOptions
+	hooks   []FrameHook
+
+	// wake tells the stream goroutine the state changed, space tells the reader there is room in the buffer.
+	// stop is closed when the stream ends.
+	wake     chan struct{}
+	space    chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// buffer has the frames read from the source with generation, SetSource starts a new one
+	buffer     []bufferedFrame
+	generation int
+	buffering  bool
+	started    bool
+	ended      bool // the source returned an error, nothing reads it anymore
+	flush      *flushRequest
+	underrunAt time.Time
+	// waitingSince is when we wanted a frame the buffer did not have yet
+	waitingSince time.Time
+	lastDuration time.Duration
+	stats        StreamStats
+
+	paused   bool
+	stopped  bool
+	position time.Duration
 
 	finished bool
 	running  bool
@@ -36,23 +108,91 @@ type StreamingSession struct {
 // vc       : The voice connecion to stream to.
 // done     : If not nil, an error will be sent on it when completed.
 func NewStream(source OpusReader, vc *discordgo.VoiceConnection, done chan error) *StreamingSession {
+	return NewStreamOptions(source, vc, done, StdStreamOptions)
+}
+
+// NewStreamOptions creates a new stream like NewStream, using options instead of StdStreamOptions
+func NewStreamOptions(source OpusReader, vc *discordgo.VoiceConnection, done chan error, options *StreamOptions) *StreamingSession {
 	session := &StreamingSession{
-		source: source,
-		vc:     vc,
-		done:   done,
+		source:    source,
+		vc:        vc,
+		done:      done,
+		options:   *options,
+		wake:      make(chan struct{}, 1),
+		space:     make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		buffering: true,
+	}
+	if session.options.BufferSize < session.options.PreRoll {
+		session.options.BufferSize = session.options.PreRoll
+	}
+	if session.options.BufferSize < 1 {
+		session.options.BufferSize = 1
+	}
+	if session.options.SendTimeout <= 0 {
+		session.options.SendTimeout = time.Second
 	}
 
+	go session.read(source, 0)
 	go session.stream()
 
 	return session
 }
 
+// read fills the buffer from source until it ends or a new source is set
+func (s *StreamingSession) read(source OpusReader, generation int) {
+	for {
+		opus, err := source.OpusFrame()
+
+		s.Lock()
+		for err == nil && s.generation == generation && s.flush == nil && len(s.buffer) >= s.options.BufferSize {
+			s.Unlock()
+			select {
+			case <-s.space:
+			case <-s.stop:
+				s.Lock()
+				s.cancelFlush()
+				s.Unlock()
+				return
+			}
+			s.Lock()
+		}
+		if s.generation != generation {
+			// SetSource threw away our frames
+			s.Unlock()
+			return
+		}
+		s.buffer = append(s.buffer, bufferedFrame{opus, source.FrameDuration(), err})
+
+		flush := s.flush
+		var frames [][]byte
+		if err != nil {
+			s.ended = true
+			s.cancelFlush()
+			flush = nil
+		} else if flush != nil {
+			frames = s.takeBuffer()
+			s.flush = nil
+		}
+		s.Unlock()
+		s.signal(s.wake)
+
+		if flush != nil {
+			// nothing is read from the source until the frames are back in it
+			flush.unread(frames)
+			flush.done <- true
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (s *StreamingSession) stream() {
-	// Check if we are already running and if so stop
+	// There is only one stream goroutine, pausing blocks it instead of ending it
 	s.Lock()
-	if s.running {
+	if s.running || s.finished {
 		s.Unlock()
-		panic("Stream is already running!")
 		return
 	}
 	s.running = true
@@ -64,103 +204,328 @@ func (s *StreamingSession) stream() {
 		s.Unlock()
 	}()
 
+	silenced := false
 	for {
 		s.Lock()
-		if s.paused {
-			s.Unlock()
+		stopped, paused := s.stopped, s.paused
+		s.Unlock()
+
+		if stopped {
+			s.sendSilence()
+			s.finish(ErrStreamStopped)
 			return
 		}
-		s.Unlock()
 
-		err := s.readNext()
-		if err != nil {
-			s.Lock()
+		if paused {
+			if !silenced {
+				s.sendSilence()
+				silenced = true
+			}
+			<-s.wake
+			continue
+		}
+		silenced = false
 
-			s.finished = true
-			if err != io.EOF {
-				s.err = err
+		frame, ok, timeout, underrun := s.next()
+		if underrun {
+			s.sendSilence()
+		}
+		if !ok {
+			s.waitWake(timeout)
+			continue
+		}
+
+		err := frame.err
+		if err == nil {
+			err = s.send(frame)
+		}
+		if err != nil {
+			if err != ErrVoiceConnClosed {
+				s.sendSilence()
 			}
+			s.finish(err)
+			return
+		}
+	}
+}
+
+// next takes the next frame out of the buffer, ok is false if we have to wait for the buffer to fill up,
+// for at most timeout if it is not 0. underrun is true if the buffer just ran dry.
+func (s *StreamingSession) next() (frame bufferedFrame, ok bool, timeout time.Duration, underrun bool) {
+	s.Lock()
+	defer s.Unlock()
 
-			if s.done != nil {
-				go func() {
-					s.done <- err
-				}()
+	if s.buffering {
+		ended := len(s.buffer) > 0 && s.buffer[len(s.buffer)-1].err != nil
+		if len(s.buffer) == 0 || len(s.buffer) < s.options.PreRoll && !ended {
+			return bufferedFrame{}, false, 0, false
+		}
+		s.buffering = false
+
+		if !s.underrunAt.IsZero() {
+			stalled := time.Since(s.underrunAt)
+			s.stats.Stalled += stalled
+
+			if s.options.CatchUp && s.buffer[0].duration > 0 {
+				// skip the frames that should have played while we waited, keeping one to play
+				skip := min(int(stalled/s.buffer[0].duration), len(s.buffer)-1)
+				s.buffer = s.buffer[skip:]
+				s.stats.Dropped += skip
+				s.signal(s.space)
 			}
+			s.underrunAt = time.Time{}
+		}
+	}
 
-			s.Unlock()
-			break
+	if len(s.buffer) == 0 {
+		if !s.started {
+			s.buffering = true
+			return bufferedFrame{}, false, 0, false
 		}
+
+		// a frame that comes in before the last one finished playing is only late
+		if s.waitingSince.IsZero() {
+			s.waitingSince = time.Now()
+		}
+		waited := time.Since(s.waitingSince)
+		if waited < s.lastDuration {
+			return bufferedFrame{}, false, s.lastDuration - waited, false
+		}
+
+		s.buffering = true
+		s.stats.Underruns++
+		s.underrunAt = s.waitingSince
+		s.waitingSince = time.Time{}
+		return bufferedFrame{}, false, 0, true
 	}
+
+	if !s.waitingSince.IsZero() {
+		s.stats.LateFrames++
+		s.waitingSince = time.Time{}
+	}
+
+	frame = s.buffer[0]
+	s.buffer = s.buffer[1:]
+	s.started = true
+	s.lastDuration = frame.duration
+	s.signal(s.space)
+
+	return frame, true, 0, false
 }
 
-func (s *StreamingSession) readNext() error {
-	opus, err := s.source.OpusFrame()
-	if err != nil {
-		return err
+func min(a, b int) int {
+	if a < b {
+		return a
 	}
+	return b
+}
 
-	// Timeout after 100ms (Maybe this needs to be changed?)
-	timeOut := time.NewTimer(time.Second)
+// send gives a frame to discord
+func (s *StreamingSession) send(frame bufferedFrame) error {
+	timeOut := time.NewTimer(s.options.SendTimeout)
+	defer timeOut.Stop()
 
-	// This will attempt to send on the channel before the timeout, which is 1s
+	// a stopped stream drops the frame
 	select {
 	case <-timeOut.C:
 		return ErrVoiceConnClosed
-	case s.vc.OpusSend <- opus:
-		timeOut.Stop()
+	case <-s.stop:
+		return nil
+	case s.vc.OpusSend <- frame.data:
 	}
 
 	s.Lock()
-	s.framesSent++
+	s.position += frame.duration
+	position := s.position
+	hooks := s.hooks
 	s.Unlock()
 
+	for _, hook := range hooks {
+		hook(frame.data, position)
+	}
+
 	return nil
 }
 
-// SetPaused provides pause/unpause functionality
-func (s *StreamingSession) SetPaused(paused bool) {
+// finish marks the stream as finished and reports err on the done channel
+func (s *StreamingSession) finish(err error) {
+	s.closeStop()
+
 	s.Lock()
+	defer s.Unlock()
 
-	if s.finished {
-		s.Unlock()
-		return
+	s.finished = true
+	if err != io.EOF {
+		s.err = err
+	}
+
+	if s.done != nil {
+		go func() {
+			s.done <- err
+		}()
 	}
+}
+
+func (s *StreamingSession) closeStop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// sendSilence sends silence frames, giving up if discord does not take them
+func (s *StreamingSession) sendSilence() {
+	timeOut := time.NewTimer(100 * time.Millisecond)
+	defer timeOut.Stop()
 
-	// Already running
-	if !paused && s.running {
-		if s.paused {
-			// Was set to stop running after next frame so undo this
-			s.paused = false
+	for i := 0; i < silenceFrames; i++ {
+		select {
+		case <-timeOut.C:
+			return
+		case s.vc.OpusSend <- SilenceFrame:
 		}
+	}
+}
 
+// waitWake waits for a signal on wake, or for timeout if it is not 0
+func (s *StreamingSession) waitWake(timeout time.Duration) {
+	if timeout == 0 {
+		<-s.wake
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.wake:
+	case <-timer.C:
+	}
+}
+
+// signal wakes up a goroutine waiting on c, if it is not already woken up
+func (s *StreamingSession) signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// SetPaused provides pause/unpause functionality, the buffer keeps filling while paused
+func (s *StreamingSession) SetPaused(paused bool) {
+	s.Lock()
+	if s.finished || s.stopped {
 		s.Unlock()
 		return
 	}
+	s.paused = paused
+	s.Unlock()
 
-	// Already stopped
-	if paused && !s.running {
-		// Not running, but starting up..
-		if !s.paused {
-			s.paused = true
-		}
+	s.signal(s.wake)
+}
 
+// Stop ends the stream after sending silence, done receives ErrStreamStopped.
+// The source is not stopped, a frame it is still reading is dropped.
+func (s *StreamingSession) Stop() {
+	s.Lock()
+	if s.finished || s.stopped {
 		s.Unlock()
 		return
 	}
+	s.stopped = true
+	s.Unlock()
+
+	s.closeStop()
+	s.signal(s.wake)
+}
+
+// Flush takes the frames read ahead out of the buffer, they are given to unread before the next frame
+// is read from the source. This way a source can change what plays next without waiting for the buffer,
+// like a Mixer that mixes a clip over them. It returns false without calling unread if the stream
+// is over or the source ended.
+func (s *StreamingSession) Flush(unread func(frames [][]byte)) bool {
+	s.Lock()
+	if s.finished || s.stopped || s.ended || s.flush != nil {
+		s.Unlock()
+		return false
+	}
+	flush := &flushRequest{unread: unread, done: make(chan bool, 1)}
+	s.flush = flush
+	s.Unlock()
+
+	// a reader waiting for room in the buffer takes it right away
+	s.signal(s.space)
+	return <-flush.done
+}
 
-	// Time to start it up again
-	if !s.running && s.paused && !paused {
-		go s.stream()
+// takeBuffer empties the buffer and returns the frames that were in it, s must be locked
+func (s *StreamingSession) takeBuffer() [][]byte {
+	frames := [][]byte{}
+	for _, frame := range s.buffer {
+		frames = append(frames, frame.data)
 	}
+	s.buffer = nil
+	// filling the buffer again is not an underrun
+	s.buffering = true
+	s.underrunAt = time.Time{}
+	s.waitingSince = time.Time{}
+	s.started = false
+	return frames
+}
 
-	s.paused = paused
+// cancelFlush tells a waiting Flush that the reader will not get to it, s must be locked
+func (s *StreamingSession) cancelFlush() {
+	if s.flush != nil {
+		s.flush.done <- false
+		s.flush = nil
+	}
+}
+
+// SetSource makes the stream continue with frames from source, for example a decoder that was seeked.
+// The frames buffered from the old source are thrown away and the playback position keeps counting.
+func (s *StreamingSession) SetSource(source OpusReader) {
+	s.Lock()
+	if s.finished {
+		s.Unlock()
+		return
+	}
+	s.source = source
+	s.generation++
+	s.takeBuffer()
+	s.ended = false
+	generation := s.generation
 	s.Unlock()
+
+	// the old reader leaves once its read returns
+	s.signal(s.space)
+	go s.read(source, generation)
+}
+
+// AddFrameHook calls hook from the stream goroutine after every frame sent,
+// it should return quickly as it holds up the stream
+func (s *StreamingSession) AddFrameHook(hook FrameHook) {
+	s.Lock()
+	// copy so send can call the hooks without the lock
+	s.hooks = append(s.hooks[:len(s.hooks):len(s.hooks)], hook)
+	s.Unlock()
+}
+
+// Stats returns how well the source keeps up with playback
+func (s *StreamingSession) Stats() StreamStats {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := s.stats
+	for _, frame := range s.buffer {
+		if frame.err == nil {
+			stats.Buffered++
+		}
+	}
+	return stats
 }
 
 // PlaybackPosition returns the the duration of content we have transmitted so far
 func (s *StreamingSession) PlaybackPosition() time.Duration {
 	s.Lock()
-	dur := time.Duration(s.framesSent) * s.source.FrameDuration()
+	dur := s.position
 	s.Unlock()
 	return dur
 }
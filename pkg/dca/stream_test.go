@@ -0,0 +1,212 @@
+package dca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// sliceReader is an OpusReader over frames in memory
+type sliceReader struct {
+	frames [][]byte
+}
+
+func (r *sliceReader) OpusFrame() ([]byte, error) {
+	if len(r.frames) == 0 {
+		return nil, ErrKilled
+	}
+	frame := r.frames[0]
+	r.frames = r.frames[1:]
+	return frame, nil
+}
+
+func (r *sliceReader) FrameDuration() time.Duration {
+	return 20 * time.Millisecond
+}
+
+func numberedFrames(n int) [][]byte {
+	frames := [][]byte{}
+	for i := 0; i < n; i++ {
+		frames = append(frames, FakeFrame(i))
+	}
+	return frames
+}
+
+// receive reads a frame discord would get
+func receive(t *testing.T, vc *discordgo.VoiceConnection) []byte {
+	select {
+	case frame := <-vc.OpusSend:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("no frame sent")
+		return nil
+	}
+}
+
+func expectSilence(t *testing.T, vc *discordgo.VoiceConnection) {
+	for i := 0; i < silenceFrames; i++ {
+		frame := receive(t, vc)
+		if !bytes.Equal(frame, SilenceFrame) {
+			t.Fatalf("expected silence frame %d, got %x", i, frame)
+		}
+	}
+}
+
+func TestStreamPauseStop(t *testing.T) {
+	vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte)}
+	done := make(chan error)
+	stream := NewStream(&sliceReader{numberedFrames(100)}, vc, done)
+
+	positions := []time.Duration{}
+	stream.AddFrameHook(func(frame []byte, position time.Duration) {
+		positions = append(positions, position)
+	})
+
+	receive(t, vc)
+
+	stream.SetPaused(true)
+	// the frame that was being read still goes out
+	receive(t, vc)
+	expectSilence(t, vc)
+
+	select {
+	case frame := <-vc.OpusSend:
+		t.Fatalf("got frame %x while paused", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream.SetPaused(false)
+	stream.SetPaused(true)
+	stream.SetPaused(false)
+	receive(t, vc)
+
+	stream.SetSource(&sliceReader{[][]byte{{1, 2, 3}}})
+	for {
+		frame := receive(t, vc)
+		if bytes.Equal(frame, []byte{1, 2, 3}) {
+			break
+		}
+	}
+	// the new source ends with an error
+	expectSilence(t, vc)
+
+	err := <-done
+	if err != ErrKilled {
+		t.Errorf("expected the source error, got %v", err)
+	}
+	if len(positions) == 0 || positions[len(positions)-1] != stream.PlaybackPosition() {
+		t.Errorf("the hooks did not see the last position %s", stream.PlaybackPosition())
+	}
+	finished, _ := stream.Finished()
+	if !finished {
+		t.Error("expected the stream to be finished")
+	}
+
+	stream = NewStream(&sliceReader{numberedFrames(100)}, vc, done)
+	receive(t, vc)
+	stream.Stop()
+	stream.SetPaused(true)
+	// the frame that was being sent is either dropped or sent
+	if frame := receive(t, vc); !bytes.Equal(frame, SilenceFrame) {
+		receive(t, vc)
+	}
+	for i := 1; i < silenceFrames; i++ {
+		if frame := receive(t, vc); !bytes.Equal(frame, SilenceFrame) {
+			t.Fatalf("expected silence frame %d, got %x", i, frame)
+		}
+	}
+	if err := <-done; err != ErrStreamStopped {
+		t.Errorf("expected ErrStreamStopped, got %v", err)
+	}
+}
+
+// stallingReader stops for a while after some frames, like a download that stalls
+type stallingReader struct {
+	sliceReader
+	stallAfter int
+	stall      time.Duration
+}
+
+func (r *stallingReader) OpusFrame() ([]byte, error) {
+	if r.stallAfter == 0 {
+		time.Sleep(r.stall)
+	}
+	r.stallAfter--
+	return r.sliceReader.OpusFrame()
+}
+
+func TestStreamUnderrun(t *testing.T) {
+	for _, catchUp := range []bool{false, true} {
+		vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte)}
+		done := make(chan error)
+		source := &stallingReader{sliceReader{numberedFrames(30)}, 5, 200 * time.Millisecond}
+		stream := NewStreamOptions(source, vc, done, &StreamOptions{PreRoll: 2, BufferSize: 10, CatchUp: catchUp})
+
+		received := 0
+	receiving:
+		for {
+			select {
+			case frame := <-vc.OpusSend:
+				if !bytes.Equal(frame, SilenceFrame) {
+					received++
+				}
+			case <-done:
+				break receiving
+			}
+		}
+
+		stats := stream.Stats()
+		if stats.Underruns != 1 || stats.Stalled < 100*time.Millisecond {
+			t.Errorf("expected 1 underrun, got %+v", stats)
+		}
+		if catchUp {
+			if stats.Dropped == 0 || received+stats.Dropped != 30 {
+				t.Errorf("expected late frames to be dropped, got %+v after %d frames", stats, received)
+			}
+		} else {
+			if stats.Dropped != 0 || received != 30 {
+				t.Errorf("expected late frames to be played, got %+v after %d frames", stats, received)
+			}
+		}
+	}
+}
+
+func TestStreamFlush(t *testing.T) {
+	vc := &discordgo.VoiceConnection{OpusSend: make(chan []byte)}
+	done := make(chan error)
+	stream := NewStreamOptions(&sliceReader{numberedFrames(100)}, vc, done, &StreamOptions{PreRoll: 1, BufferSize: 10})
+
+	receive(t, vc)
+	var flushed [][]byte
+	if !stream.Flush(func(frames [][]byte) { flushed = frames }) {
+		t.Fatal("expected the buffer to be flushed")
+	}
+	if len(flushed) == 0 {
+		t.Fatal("expected the frames read ahead")
+	}
+	number := func(frame []byte) uint32 {
+		return binary.BigEndian.Uint32(frame[1:])
+	}
+	for i, frame := range flushed[1:] {
+		if number(frame) != number(flushed[i])+1 {
+			t.Fatalf("expected the flushed frames in order, got %x after %x", frame, flushed[i])
+		}
+	}
+
+	// the frame that was being sent still goes out, then the stream continues after the flushed frames
+	frame := receive(t, vc)
+	if number(frame) < number(flushed[0]) {
+		frame = receive(t, vc)
+	}
+	if want := number(flushed[len(flushed)-1]) + 1; number(frame) != want {
+		t.Errorf("expected frame %d after the flush, got %x", want, frame)
+	}
+
+	stream.Stop()
+	if stream.Flush(func(frames [][]byte) { t.Error("flushed a stopped stream") }) {
+		t.Error("expected Flush to fail on a stopped stream")
+	}
+}
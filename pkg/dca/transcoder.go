@@ -0,0 +1,358 @@
+package dca
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jonas747/ogg"
+)
+
+// Transcoder turns audio into opus packets for an EncodeSession
+type Transcoder interface {
+	// Transcode starts encoding the input, it stops when ctx is done
+	Transcode(ctx context.Context, input TranscodeInput, options *EncodeOptions) (Transcoding, error)
+}
+
+// TranscodeInput is the audio to transcode, either a file/url or a reader
+type TranscodeInput struct {
+	Path   string
+	Reader io.Reader
+}
+
+// Transcoding is a started transcode
+type Transcoding interface {
+	// ReadPacket returns the next opus packet, io.EOF after the last one
+	ReadPacket() ([]byte, error)
+	// Messages returns what the transcoder logs, ffmpeg style stats lines are parsed into EncodeStats.
+	// It is nil if the transcoder has nothing to say.
+	Messages() io.Reader
+	// Wait returns why the transcoder stopped once all packets are read, nil if it finished
+	Wait() error
+	// Kill stops the transcoder
+	Kill() error
+}
+
+// DefaultTranscoder is used when the Transcoder in the EncodeOptions is nil
+var DefaultTranscoder Transcoder = FFmpeg
+
+// FFmpeg encodes with ffmpeg, which has to be in the PATH
+var FFmpeg = &CommandTranscoder{
+	Command: "ffmpeg",
+	Args:    FFmpegArgs,
+}
+
+// CommandTranscoder runs a program that reads the input from stdin or a path
+// and writes Ogg Opus to stdout, like ffmpeg, avconv or gstreamer
+type CommandTranscoder struct {
+	Command string
+	Args    func(input TranscodeInput, options *EncodeOptions) []string
+}
+
+// FFmpegArgs returns the ffmpeg arguments to encode input with options
+func FFmpegArgs(input TranscodeInput, options *EncodeOptions) []string {
+	inFile := "pipe:0"
+	if input.Path != "" {
+		inFile = input.Path
+	}
+
+	// Launch ffmpeg with a variety of different fruits and goodies mixed togheter
+	args := []string{
+		"-stats",
+		"-i", inFile,
+		"-reconnect", "1",
+		"-reconnect_at_eof", "1",
+		"-reconnect_streamed", "1",
+		"-reconnect_delay_max", "2",
+		"-map", "0:a",
+	}
+	args = append(args, ffmpegOpusArgs(options)...)
+	args = append(args, "-ss", strconv.Itoa(options.StartTime))
+
+	filters := []string{}
+	if options.AudioFilter != "" {
+		// Lit af
+		filters = append(filters, options.AudioFilter)
+	}
+	if options.Loudness {
+		// the summary is printed when ffmpeg exits, keep the per frame log out of stderr
+		filters = append(filters, "ebur128=framelog=verbose")
+	}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+
+	return append(args, "pipe:1")
+}
+
+// ffmpegOpusArgs are the ffmpeg arguments to encode to Ogg Opus with options
+func ffmpegOpusArgs(options *EncodeOptions) []string {
+	vbrStr := "on"
+	if !options.VBR {
+		vbrStr = "off"
+	}
+
+	return []string{
+		"-acodec", "libopus",
+		"-f", "ogg",
+		"-vbr", vbrStr,
+		"-compression_level", strconv.Itoa(options.CompressionLevel),
+		"-vol", strconv.Itoa(options.Volume),
+		"-ar", strconv.Itoa(options.FrameRate),
+		"-ac", strconv.Itoa(options.Channels),
+		"-b:a", strconv.Itoa(options.Bitrate * 1000),
+		"-application", string(options.Application),
+		"-frame_duration", strconv.Itoa(options.FrameDuration),
+		"-packet_loss", strconv.Itoa(options.PacketLoss),
+		"-threads", strconv.Itoa(options.Threads),
+	}
+}
+
+// Transcode implements Transcoder
+func (c *CommandTranscoder) Transcode(ctx context.Context, input TranscodeInput, options *EncodeOptions) (Transcoding, error) {
+	// the command is killed when the context is done
+	cmd := exec.CommandContext(ctx, c.Command, c.Args(input, options)...)
+
+	logln(cmd.Args)
+
+	if input.Reader != nil {
+		cmd.Stdin = input.Reader
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &commandTranscoding{
+		cmd:     cmd,
+		stderr:  stderr,
+		decoder: ogg.NewPacketDecoder(ogg.NewDecoder(stdout)),
+		// the first 2 packets are ogg opus metadata
+		skipPackets: 2,
+	}, nil
+}
+
+type commandTranscoding struct {
+	cmd         *exec.Cmd
+	stderr      io.Reader
+	decoder     *ogg.PacketDecoder
+	skipPackets int
+}
+
+func (c *commandTranscoding) ReadPacket() ([]byte, error) {
+	for {
+		// Retrieve a packet
+		packet, _, err := c.decoder.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if c.skipPackets > 0 {
+			c.skipPackets--
+			continue
+		}
+		return packet, nil
+	}
+}
+
+func (c *commandTranscoding) Messages() io.Reader {
+	return c.stderr
+}
+
+func (c *commandTranscoding) Wait() error {
+	return c.cmd.Wait()
+}
+
+func (c *commandTranscoding) Kill() error {
+	return c.cmd.Process.Kill()
+}
+
+// Passthrough sends opus from Ogg or WebM as it is, without any program or cgo.
+// It fails with ErrNotOpus or ErrOpusUnsupported if the input or the options need a real encoder.
+var Passthrough Transcoder = passthroughTranscoder{}
+
+type passthroughTranscoder struct{}
+
+func (passthroughTranscoder) Transcode(ctx context.Context, input TranscodeInput, options *EncodeOptions) (Transcoding, error) {
+	if !options.Passthrough() {
+		return nil, ErrOpusUnsupported
+	}
+
+	r := input.Reader
+	var file *os.File
+	if r == nil {
+		var err error
+		file, err = os.Open(input.Path)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+
+	demuxer, err := NewDemuxer(r)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	p := &passthroughTranscoding{
+		ctx:     ctx,
+		demuxer: demuxer,
+		file:    file,
+		closed:  make(chan struct{}),
+	}
+	if file != nil {
+		// nobody might read again after ctx is done, the file is closed anyway
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.close()
+			case <-p.closed:
+			}
+		}()
+	}
+	return p, nil
+}
+
+type passthroughTranscoding struct {
+	ctx     context.Context
+	demuxer *Demuxer
+	file    *os.File
+
+	mutex     sync.Mutex
+	killed    bool
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (p *passthroughTranscoding) ReadPacket() ([]byte, error) {
+	p.mutex.Lock()
+	killed := p.killed
+	p.mutex.Unlock()
+	if killed || p.ctx.Err() != nil {
+		p.close()
+		return nil, io.EOF
+	}
+
+	packet, err := p.demuxer.OpusFrame()
+	if err != nil {
+		p.close()
+		if p.ctx.Err() != nil || p.Killed() {
+			// the file was closed under the demuxer
+			return nil, io.EOF
+		}
+	}
+	return packet, err
+}
+
+// Killed returns true once Kill was called
+func (p *passthroughTranscoding) Killed() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.killed
+}
+
+// close closes the file the input was read from, if we opened it
+func (p *passthroughTranscoding) close() {
+	p.closeOnce.Do(func() {
+		if p.file != nil {
+			p.file.Close()
+		}
+		close(p.closed)
+	})
+}
+
+func (p *passthroughTranscoding) Messages() io.Reader {
+	return nil
+}
+
+func (p *passthroughTranscoding) Wait() error {
+	return nil
+}
+
+func (p *passthroughTranscoding) Kill() error {
+	p.mutex.Lock()
+	p.killed = true
+	p.mutex.Unlock()
+	p.close()
+	return nil
+}
+
+// FakeTranscoder ignores its input and emits numbered frames, so encoding can be tested without ffmpeg
+type FakeTranscoder struct {
+	Frames   int    // how many frames to emit
+	Messages string // logged as if ffmpeg printed it, stats lines have to end in \r
+	Err      error  // returned by Wait after the frames, to act like a crash
+}
+
+// FakeFrame returns the n'th frame a FakeTranscoder emits,
+// a 20ms stereo CELT TOC byte followed by n
+func FakeFrame(n int) []byte {
+	frame := make([]byte, 5)
+	frame[0] = 0xFC
+	binary.BigEndian.PutUint32(frame[1:], uint32(n))
+	return frame
+}
+
+// Transcode implements Transcoder
+func (f *FakeTranscoder) Transcode(ctx context.Context, input TranscodeInput, options *EncodeOptions) (Transcoding, error) {
+	return &fakeTranscoding{
+		ctx:      ctx,
+		fake:     f,
+		messages: strings.NewReader(f.Messages),
+	}, nil
+}
+
+type fakeTranscoding struct {
+	ctx      context.Context
+	fake     *FakeTranscoder
+	messages io.Reader
+	n        int
+
+	mutex  sync.Mutex
+	killed bool
+}
+
+func (f *fakeTranscoding) ReadPacket() ([]byte, error) {
+	f.mutex.Lock()
+	killed := f.killed
+	f.mutex.Unlock()
+	if killed || f.ctx.Err() != nil || f.n >= f.fake.Frames {
+		return nil, io.EOF
+	}
+
+	f.n++
+	return FakeFrame(f.n - 1), nil
+}
+
+func (f *fakeTranscoding) Messages() io.Reader {
+	return f.messages
+}
+
+func (f *fakeTranscoding) Wait() error {
+	return f.fake.Err
+}
+
+func (f *fakeTranscoding) Kill() error {
+	f.mutex.Lock()
+	f.killed = true
+	f.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,171 @@
+package dca
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeTranscoder(t *testing.T) {
+	options := *StdEncodeOptions
+	options.Transcoder = &FakeTranscoder{
+		Frames:   100,
+		Messages: "size=      12kB time=00:00:02.00 bitrate=  48.0kbits/s speed=50x\n",
+	}
+
+	session, err := EncodeMem(strings.NewReader(""), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := session.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(metadata[:4]) != "DCA1" {
+		t.Errorf("expected a metadata frame first, got %q", metadata[:4])
+	}
+
+	frames := readAllFrames(t, session)
+	if len(frames) != 100 {
+		t.Fatalf("Incorrect number of frames (got %d expected %d)", len(frames), 100)
+	}
+	for i, frame := range frames {
+		if !bytes.Equal(frame, FakeFrame(i)) {
+			t.Fatalf("frame %d is different", i)
+		}
+	}
+
+	stats := session.Stats()
+	if stats.Duration != 2*time.Second || stats.Speed != 50 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if session.Error() != nil {
+		t.Errorf("unexpected error %v", session.Error())
+	}
+}
+
+func TestFakeTranscoderErr(t *testing.T) {
+	crash := errors.New("crashed")
+
+	options := *StdEncodeOptions
+	options.RawOutput = true
+	options.Transcoder = &FakeTranscoder{Frames: 10, Err: crash}
+
+	session, err := EncodeMem(strings.NewReader(""), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = session.OpusFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+
+	_, err = session.OpusFrame()
+	if err != crash {
+		t.Errorf("expected the transcoder error, got %v", err)
+	}
+}
+
+func TestPassthroughTranscoder(t *testing.T) {
+	frames := testFrames(t)
+
+	var buf bytes.Buffer
+	o, err := NewOggWriter(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		err = o.WriteFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.Close()
+
+	options := *StdEncodeOptions
+	options.Transcoder = Passthrough
+
+	session, err := EncodeMem(&buf, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAllFrames(t, session)
+	if len(got) != len(frames) {
+		t.Fatalf("Incorrect number of frames (got %d expected %d)", len(got), len(frames))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], frames[i]) {
+			t.Fatalf("frame %d is different", i)
+		}
+	}
+
+	options.Volume = 128
+	session, err = EncodeMem(strings.NewReader(""), &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.OpusFrame()
+	if err != ErrOpusUnsupported {
+		t.Errorf("expected ErrOpusUnsupported, got %v", err)
+	}
+}
+
+func TestPassthroughClosesFile(t *testing.T) {
+	var buf bytes.Buffer
+	o, err := NewOggWriter(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range testFrames(t) {
+		o.WriteFrame(frame)
+	}
+	o.Close()
+
+	path := filepath.Join(t.TempDir(), "song.opus")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stops := map[string]func(p *passthroughTranscoding, cancel context.CancelFunc){
+		"kill": func(p *passthroughTranscoding, cancel context.CancelFunc) {
+			p.Kill()
+		},
+		"cancel": func(p *passthroughTranscoding, cancel context.CancelFunc) {
+			cancel()
+			<-p.closed
+		},
+	}
+	for name, stop := range stops {
+		ctx, cancel := context.WithCancel(context.Background())
+		transcoding, err := Passthrough.Transcode(ctx, TranscodeInput{Path: path}, StdEncodeOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := transcoding.(*passthroughTranscoding)
+		if _, err := p.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+
+		stop(p, cancel)
+		if _, err := p.file.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("%s: expected the file to be closed, got %v", name, err)
+		}
+		if _, err := p.ReadPacket(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF, got %v", name, err)
+		}
+		cancel()
+	}
+}
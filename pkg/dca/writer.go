@@ -0,0 +1,162 @@
+package dca
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// NewMetadata returns the metadata describing audio encoded with options
+func NewMetadata(options *EncodeOptions) *Metadata {
+	return &Metadata{
+		Dca: &DCAMetadata{
+			Version: FormatVersion,
+			Tool: &DCAToolMetadata{
+				Name:    "dca",
+				Version: LibraryVersion,
+				Url:     GitHubRepositoryURL,
+				Author:  "jonas747",
+			},
+		},
+		Opus: &OpusMetadata{
+			Bitrate:     options.Bitrate * 1000,
+			SampleRate:  options.FrameRate,
+			Application: string(options.Application),
+			FrameSize:   options.PCMFrameLen(),
+			Channels:    options.Channels,
+			VBR:         options.VBR,
+		},
+		SongInfo: &SongMetadata{},
+		Origin:   &OriginMetadata{},
+		Extra:    &ExtraMetadata{},
+	}
+}
+
+// writeHeader writes the magic bytes and the metadata frame
+func writeHeader(w io.Writer, metadata *Metadata) error {
+	jsonData, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	version := FormatVersion
+	if metadata.Dca != nil && metadata.Dca.Version > 0 {
+		version = metadata.Dca.Version
+	}
+
+	_, err = fmt.Fprintf(w, "DCA%d", version)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, int32(len(jsonData)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(jsonData)
+	return err
+}
+
+// Writer writes opus frames as a dca file
+type Writer struct {
+	w io.Writer
+
+	index *FrameIndex
+	pos   int64
+	frame int
+}
+
+// NewWriter writes the metadata to w and returns a writer for the frames that follow,
+// a nil metadata writes raw dca frames without a header
+func NewWriter(w io.Writer, metadata *Metadata) (*Writer, error) {
+	if metadata != nil {
+		err := writeHeader(w, metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Writer{w: w}, nil
+}
+
+// NewIndexedWriter writes a version 2 dca file, Close writes the frame index
+func NewIndexedWriter(w io.Writer, metadata *Metadata) (*Writer, error) {
+	// do not change the version in the metadata of the caller
+	m := *metadata
+	dcaMetadata := DCAMetadata{}
+	if m.Dca != nil {
+		dcaMetadata = *m.Dca
+	}
+	dcaMetadata.Version = IndexedFormatVersion
+	m.Dca = &dcaMetadata
+
+	var header bytes.Buffer
+	err := writeHeader(&header, &m)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:     w,
+		index: newFrameIndex(),
+		pos:   int64(header.Len()),
+	}, nil
+}
+
+// WriteFrame writes a single opus frame
+func (d *Writer) WriteFrame(frame []byte) error {
+	if d.index != nil {
+		d.index.add(d.frame, d.pos)
+		d.pos += int64(2 + len(frame))
+		d.frame++
+	}
+
+	err := binary.Write(d.w, binary.LittleEndian, int16(len(frame)))
+	if err != nil {
+		return err
+	}
+
+	_, err = d.w.Write(frame)
+	return err
+}
+
+// Close writes the frame index if there is one, it does not close the underlying writer
+func (d *Writer) Close() error {
+	if d.index == nil {
+		return nil
+	}
+	return d.index.writeTo(d.w)
+}
+
+type teeReader struct {
+	r OpusReader
+	w *Writer
+}
+
+// TeeReader returns an OpusReader that writes every frame it reads from r to w,
+// like io.TeeReader any error writing is returned as a read error
+func TeeReader(r OpusReader, w *Writer) OpusReader {
+	return &teeReader{r: r, w: w}
+}
+
+func (t *teeReader) OpusFrame() (frame []byte, err error) {
+	frame, err = t.r.OpusFrame()
+	if err != nil {
+		return
+	}
+
+	err = t.w.WriteFrame(frame)
+	return
+}
+
+func (t *teeReader) FrameDuration() time.Duration {
+	return t.r.FrameDuration()
+}
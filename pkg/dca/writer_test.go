@@ -0,0 +1,104 @@
+package dca
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/jonas747/ogg"
+)
+
+func TestWriter(t *testing.T) {
+	file, err := os.Open("testaudio.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	decoder := NewDecoder(file)
+	err = decoder.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, decoder.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tee := TeeReader(decoder, w)
+	for {
+		_, err := tee.OpusFrame()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	// read back what we wrote
+	decoder = NewDecoder(&buf)
+	err = decoder.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frameCounter := 0
+	for {
+		_, err := decoder.OpusFrame()
+		if err != nil {
+			if err != io.EOF {
+				t.Error(err)
+			}
+			break
+		}
+		frameCounter++
+	}
+
+	if frameCounter != 755 {
+		t.Errorf("Incorrect number of frames (got %d expected %d)", frameCounter, 755)
+	}
+}
+
+func TestOggReader(t *testing.T) {
+	file, err := os.Open("testaudio.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r := OggReader(NewDecoder(file), 2)
+	defer r.Close()
+
+	decoder := ogg.NewDecoder(r)
+	pages := 0
+	var last ogg.Page
+	for {
+		page, err := decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		if page.Page != uint32(pages) {
+			t.Errorf("page %d has sequence number %d", pages, page.Page)
+		}
+		pages++
+		last = page
+	}
+
+	// OpusHead and OpusTags come before the frames, one frame per page
+	if pages != 755+2 {
+		t.Errorf("Incorrect number of pages (got %d expected %d)", pages, 755+2)
+	}
+	if last.Type&ogg.EOS == 0 {
+		t.Error("the last page does not end the stream")
+	}
+	if last.Granule != 755*960 {
+		t.Errorf("expected the stream to end at granule %d, got %d", 755*960, last.Granule)
+	}
+}
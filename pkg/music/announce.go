@@ -0,0 +1,245 @@
+package music
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// speakTimeout is how long the TTS engine gets to say something
+const speakTimeout = 20 * time.Second
+
+const defaultAnnounceLanguage = "en"
+
+// announceLanguage is what a language code can look like, it ends up in file names and arguments
+var announceLanguage = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{2})?$`)
+
+// announcements are the "next up" lines per language, with the title and who asked for it
+var announcements = map[string]string{
+	"en": "Next up: %s, requested by %s",
+	"nl": "Nu volgt: %s, aangevraagd door %s",
+	"de": "Als Nächstes: %s, gewünscht von %s",
+	"fr": "Ensuite : %s, demandé par %s",
+	"es": "A continuación: %s, pedido por %s",
+}
+
+// TTSEngine turns text into speech, in any audio format ffmpeg can read
+type TTSEngine interface {
+	Speak(ctx context.Context, text, language string) (io.Reader, error)
+}
+
+// NewTTSEngine sets up a TTS engine from its description:
+// espeak-ng, piper:<directory with a <language>.onnx voice per language>
+// or a http(s) link with {text} and {lang} in it that returns audio
+func NewTTSEngine(engine string) (TTSEngine, error) {
+	switch {
+	case engine == "espeak-ng" || engine == "espeak":
+		return &commandTTS{
+			command: engine,
+			args: func(language string) []string {
+				return []string{"-v", language, "--stdout", "--stdin"}
+			},
+		}, nil
+	case strings.HasPrefix(engine, "piper:"):
+		voices := strings.TrimPrefix(engine, "piper:")
+		return &commandTTS{
+			command: "piper",
+			args: func(language string) []string {
+				return []string{"--model", filepath.Join(voices, language+".onnx"), "--output_file", "-"}
+			},
+		}, nil
+	case strings.HasPrefix(engine, "http://") || strings.HasPrefix(engine, "https://"):
+		return httpTTS(engine), nil
+	}
+
+	return nil, fmt.Errorf("unknown TTS engine %q", engine)
+}
+
+// commandTTS runs a local program that reads text on stdin and writes audio to stdout
+type commandTTS struct {
+	command string
+	args    func(language string) []string
+}
+
+func (c *commandTTS) Speak(ctx context.Context, text, language string) (io.Reader, error) {
+	if !announceLanguage.MatchString(language) {
+		return nil, fmt.Errorf("invalid language %q", language)
+	}
+
+	cmd := exec.CommandContext(ctx, c.command, c.args(language)...)
+	cmd.Stdin = strings.NewReader(text)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", c.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return bytes.NewReader(out), nil
+}
+
+// httpTTS asks a TTS server, {text} and {lang} in the link are filled in
+type httpTTS string
+
+func (h httpTTS) Speak(ctx context.Context, text, language string) (io.Reader, error) {
+	link := strings.NewReplacer("{text}", url.QueryEscape(text), "{lang}", url.QueryEscape(language)).Replace(string(h))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TTS server returned %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// announcementText is what we say before a song
+func announcementText(song Song, requester, language string) string {
+	format, ok := announcements[strings.SplitN(language, "-", 2)[0]]
+	if !ok {
+		format = announcements[defaultAnnounceLanguage]
+	}
+	return fmt.Sprintf(format, song.Title, requester)
+}
+
+// requesterName returns the name of the user in the guild as people see it
+func (v *VoiceInstance) requesterName(userID string) string {
+	member, err := v.session.State.Member(v.guildID, userID)
+	if err != nil {
+		member, err = v.session.GuildMember(v.guildID, userID)
+	}
+	if err != nil || member.User == nil {
+		return "someone"
+	}
+	if member.Nick != "" {
+		return member.Nick
+	}
+	return member.User.Username
+}
+
+// announce says which song comes next, if the guild turned that on
+func (v *VoiceInstance) announce(song Song) {
+	if v.tts == nil || v.settings == nil || v.session == nil {
+		return
+	}
+	settings := v.settings.Get(v.guildID)
+	if !settings.Announce {
+		return
+	}
+
+	language := settings.AnnounceLanguage
+	if !announceLanguage.MatchString(language) {
+		language = defaultAnnounceLanguage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), speakTimeout)
+	defer cancel()
+	requester := v.requesterName(song.User)
+	if song.Autoplay {
+		requester = "autoplay"
+	}
+	speech, err := v.tts.Speak(ctx, announcementText(song, requester, language), language)
+	if err != nil {
+		log.Println("Could not announce the song: ", err)
+		return
+	}
+
+	opts := *dca.StdEncodeOptions
+	opts.RawOutput = true
+	opts.Bitrate = v.bitrate
+	opts.Application = "voip"
+	opts.Volume = v.volume
+
+	encodeSession, err := dca.EncodeMem(speech, &opts)
+	if err != nil {
+		log.Println("Could not announce the song: ", err)
+		return
+	}
+	defer encodeSession.Cleanup()
+
+	// skip and stop work on the announcement too
+	v.encoder = encodeSession
+	v.player = nil
+	done := make(chan error)
+	v.stream = dca.NewStream(encodeSession, v.voice, done)
+
+	err = <-done
+	v.encoder = nil
+	if err != nil && err != io.EOF && !errors.Is(err, dca.ErrKilled) && !errors.Is(err, dca.ErrStreamStopped) {
+		log.Println("Could not announce the song: ", err)
+	}
+}
+
+// Announce handles the /announce command
+func (mc *MusicCommand) Announce(i *discordgo.InteractionCreate) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can change the announcements")
+		return
+	}
+
+	enabled := false
+	language := ""
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Name {
+		case "enabled":
+			enabled = option.BoolValue()
+		case "language":
+			language = strings.ToLower(option.StringValue())
+		}
+	}
+	if language != "" && !announceLanguage.MatchString(language) {
+		mc.respondHidden(i, "I don't know that language, use a code like `en` or `pt-br`")
+		return
+	}
+
+	err := mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		g.Announce = enabled
+		if language != "" {
+			g.AnnounceLanguage = language
+		}
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.respondHidden(i, "I could not save that, I'm sorry :(")
+		return
+	}
+
+	content := "Okay, I'll keep my mouth shut between songs"
+	if enabled {
+		content = "Okay, I'll announce every song, like a real DJ!"
+	}
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+		},
+	})
+}
@@ -0,0 +1,87 @@
+package music
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAnnouncementText(t *testing.T) {
+	song := Song{Title: "Daft Punk - One More Time"}
+
+	tests := []struct {
+		language string
+		want     string
+	}{
+		{"en", "Next up: Daft Punk - One More Time, requested by Maartje"},
+		{"nl", "Nu volgt: Daft Punk - One More Time, aangevraagd door Maartje"},
+		{"nl-be", "Nu volgt: Daft Punk - One More Time, aangevraagd door Maartje"},
+		{"pt-br", "Next up: Daft Punk - One More Time, requested by Maartje"},
+		{"", "Next up: Daft Punk - One More Time, requested by Maartje"},
+	}
+
+	for _, test := range tests {
+		got := announcementText(song, "Maartje", test.language)
+		if got != test.want {
+			t.Errorf("announcementText in %q = %q, expected %q", test.language, got, test.want)
+		}
+	}
+}
+
+func TestNewTTSEngine(t *testing.T) {
+	tests := []struct {
+		engine  string
+		command string
+		args    []string
+		err     bool
+	}{
+		{"espeak-ng", "espeak-ng", []string{"-v", "nl-be", "--stdout", "--stdin"}, false},
+		{"espeak", "espeak", []string{"-v", "nl-be", "--stdout", "--stdin"}, false},
+		{"piper:/voices", "piper", []string{"--model", "/voices/nl-be.onnx", "--output_file", "-"}, false},
+		{"https://tts.example.com/?q={text}&l={lang}", "", nil, false},
+		{"say", "", nil, true},
+	}
+
+	for _, test := range tests {
+		engine, err := NewTTSEngine(test.engine)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected an error for %q", test.engine)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.engine, err)
+			continue
+		}
+
+		c, ok := engine.(*commandTTS)
+		if test.command == "" {
+			if ok {
+				t.Errorf("expected %q not to run a command", test.engine)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("expected %q to run a command, got %T", test.engine, engine)
+			continue
+		}
+		if c.command != test.command || !reflect.DeepEqual(c.args("nl-be"), test.args) {
+			t.Errorf("%q runs %s %v, expected %s %v", test.engine, c.command, c.args("nl-be"), test.command, test.args)
+		}
+	}
+}
+
+func TestTTSLanguage(t *testing.T) {
+	engine, err := NewTTSEngine("piper:/voices")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, language := range []string{"../../etc/passwd", "en/../x", "-w /tmp/x", "EN", "english"} {
+		_, err := engine.Speak(context.Background(), "hello", language)
+		if err == nil {
+			t.Errorf("expected language %q to be refused", language)
+		}
+	}
+}
@@ -2,16 +2,36 @@ package music
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/meyskens/thomas-disco/pkg/dca"
 )
 
+// errSongKilled aborts storing a song that was not played until the end
+var errSongKilled = errors.New("song was stopped before the end")
+
+// streamOptions buffers a second of a song before it starts playing, so a slow download doesn't stutter
+var streamOptions = &dca.StreamOptions{
+	PreRoll:     50,
+	BufferSize:  250,
+	SendTimeout: time.Second,
+}
+
+// liveStreamOptions skips what was missed when a live stream stalls, to stay live
+var liveStreamOptions = &dca.StreamOptions{
+	PreRoll:     50,
+	BufferSize:  150,
+	SendTimeout: time.Second,
+	CatchUp:     true,
+}
+
 func GlobalPlay(songSig chan PkgSong) {
 	for {
 		song := <-songSig
@@ -20,22 +40,43 @@ func GlobalPlay(songSig chan PkgSong) {
 }
 
 type VoiceInstance struct {
-	voice      *discordgo.VoiceConnection
-	session    *discordgo.Session
-	encoder    *dca.EncodeSession
-	stream     *dca.StreamingSession
-	queueMutex sync.Mutex
-	audioMutex sync.Mutex
-	nowPlaying Song
-	queue      []Song
-	recv       []int16
-	guildID    string
-	channelID  string
-	speaking   bool
-	pause      bool
-	stop       bool
-	skip       bool
-	volume     int
+	voice       *discordgo.VoiceConnection
+	session     *discordgo.Session
+	encoder     *dca.EncodeSession
+	player      *killableReader
+	stream      *dca.StreamingSession
+	mixer       *dca.Mixer
+	sfxMutex    sync.Mutex
+	recorder    *recorder
+	recordMutex sync.Mutex
+	speakingVC  *discordgo.VoiceConnection // connection our speaking handler is on
+	queueMutex  sync.Mutex
+	audioMutex  sync.Mutex
+	nowPlaying  Song
+	queue       []Song
+
+	positions *positionStore
+	cache     SongCache
+	index     *CacheIndex
+	downloads *downloads
+	settings  *settingsStore
+	tts       TTSEngine
+	lyrics    LyricsProvider
+	autoplay  *autoplayer
+	history   *historyStore
+
+	nowPlayingMutex   sync.Mutex
+	nowPlayingMessage *discordgo.Message
+	onAir             string
+
+	guildID   string
+	channelID string
+	speaking  bool
+	pause     bool
+	karaoke   bool // vocals filtered out and lyrics shown
+	stop      bool
+	skip      bool
+	volume    int
 
 	musicOpts MusicOptions
 
@@ -44,7 +85,7 @@ type VoiceInstance struct {
 
 func NewVoiceInstance(birtate int, opts MusicOptions) *VoiceInstance {
 	return &VoiceInstance{
-		volume:    265,
+		volume:    256, // 100%, songs are only cached at this volume
 		bitrate:   birtate,
 		musicOpts: opts,
 	}
@@ -60,9 +101,19 @@ func (v *VoiceInstance) PlayQueue(song Song) {
 	go func() {
 		v.audioMutex.Lock()
 		defer v.audioMutex.Unlock()
+		// songs in a row that did not play
+		failures := 0
 		for {
 			if len(v.queue) == 0 {
-				return
+				if failures >= autoplayMaxFailures {
+					log.Printf("Not autoplaying after %d songs failed", failures)
+					return
+				}
+				song, ok := v.autoplayNext()
+				if !ok {
+					return
+				}
+				v.QueueAdd(song)
 			}
 			v.nowPlaying = v.QueueGetSong()
 			v.stop = false
@@ -70,10 +121,25 @@ func (v *VoiceInstance) PlayQueue(song Song) {
 			v.speaking = true
 			v.pause = false
 			v.voice.Speaking(true)
+			v.sendNowPlaying()
 
-			v.DCA(v.nowPlaying.VidID)
+			v.announce(v.nowPlaying)
+			played := false
+			if !v.stop {
+				played = v.DCA(v.nowPlaying)
+			}
+
+			if played {
+				failures = 0
+			} else if !v.stop {
+				failures++
+			}
+			if played && v.history != nil && v.nowPlaying.Source != SourceLive {
+				v.history.Add(v.guildID, v.nowPlaying)
+			}
 
 			v.QueueRemoveFisrt()
+			stopped := v.stop
 			if v.stop {
 				v.QueueRemove()
 			}
@@ -81,134 +147,225 @@ func (v *VoiceInstance) PlayQueue(song Song) {
 			v.skip = false
 			v.speaking = false
 			v.voice.Speaking(false)
+			if stopped {
+				// autoplay should not pick up after a stop
+				return
+			}
 		}
 	}()
 }
 
-// DCA
-func (v *VoiceInstance) DCA(name string) {
-	store := true
-	if v.musicOpts.S3Bucket == "" {
-		log.Println("No S3 bucket specified, not saving")
-		store = false
-	}
-	s3, err := NewS3(v.musicOpts.S3Endpoint, v.musicOpts.S3Region, v.musicOpts.S3Bucket, v.musicOpts.S3Access, v.musicOpts.S3Secret)
-	if err != nil {
-		log.Println("failed creating an S3 session: ", err)
+// DCA plays a song, played is true if some of it was heard and it did not fail
+func (v *VoiceInstance) DCA(song Song) (played bool) {
+	name := song.CacheKey()
+
+	if song.Source == SourceLive {
+		return v.playLive(song)
 	}
 
-	opts := dca.StdEncodeOptions
+	// copy the defaults, we do not want to change them for everyone
+	opts := *dca.StdEncodeOptions
 	opts.RawOutput = true
 	opts.Bitrate = v.bitrate
 	opts.Application = "lowdelay"
 	opts.Volume = v.volume
+	opts.StartTime = int(song.Start.Seconds())
+	if v.karaoke {
+		opts.AudioFilter = karaokeFilter
+	}
+
+	// killing the player stops ffmpeg right away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	var encodeSession *dca.EncodeSession
-	var out *os.File
-
-	s3File, err := s3.Get(name)
-	if err == nil {
-		log.Println("Got song from S3")
-		store = false
-		// found file on s3
-		// download 100k bytes before encoding
-		bufferedReader := bufio.NewReaderSize(s3File, 2*1024*1024)
-		bufferedReader.Peek(100 * 1024)
-		defer s3File.Close()
-
-		encodeSession, err = dca.EncodeMem(bufferedReader, opts)
-		if err != nil {
-			log.Println("FATA: Failed creating an encoding session: ", err)
-		}
-	} else if store {
-		log.Printf("Song not found on S3 %q, downloading", err)
-		// download the audio to s3
-		dw, err := downloadWithYTDLP(name)
-		if err != nil {
-			log.Println("FATA: Failed downloading the audio: ", err)
-		}
-		defer dw.Close()
+	var source dca.OpusReader
+	var verify *hashReader
+	var err error
+
+	cacheErr := ErrNotCached
+	var cached io.ReadCloser
+	if v.cache != nil && song.Cacheable() {
+		cached, cacheErr = v.cache.Get(name)
+	}
 
-		// store to disk using a teereader
-		os.Remove(name) // if it exists is probably is corrupt!
-		out, err = os.Create(name)
+	if song.Source == SourceLibrary && opts.Passthrough() {
+		// opus files in the library can be sent as they are
+		file, err := os.Open(song.URL)
 		if err != nil {
-			log.Println("Error creating output file:", err)
+			log.Println("FATA: Failed opening the song: ", err)
 			return
 		}
+		defer file.Close()
 
-		r := io.TeeReader(dw, out)
-
-		// download 100k bytes before encoding
-		bufferedReader := bufio.NewReaderSize(r, 2*1024*1024)
-		bufferedReader.Peek(100 * 1024)
-
-		encodeSession, err = dca.EncodeMem(bufferedReader, opts)
+		source, encodeSession, err = dca.DemuxOrEncodeContext(ctx, bufio.NewReader(file), &opts)
 		if err != nil {
 			log.Println("FATA: Failed creating an encoding session: ", err)
 		}
-	} else {
-		dw, err := downloadWithYTDLP(name)
+	} else if !song.Cacheable() {
+		// ffmpeg reads the file itself, reconnecting if the connection drops
+		encodeSession, err = dca.EncodeFileContext(ctx, song.URL, &opts)
 		if err != nil {
-			log.Println("FATA: Failed downloading the audio: ", err)
+			log.Println("FATA: Failed creating an encoding session: ", err)
+		}
+	} else {
+		var r io.Reader
+		if cacheErr == nil {
+			log.Println("Got song from cache")
+			defer cached.Close()
+			v.index.Played(song)
+
+			known, _ := v.index.Get(name)
+			verify = newHashReader(cached, known.SHA256)
+			r = verify
+		} else {
+			if v.cache != nil {
+				log.Printf("Song not found in cache %q, downloading", cacheErr)
+			}
+			// if someone else is already playing the song we read along with their download
+			download := v.downloads.Open(song)
+			defer download.Close()
+			r = download
 		}
-		defer dw.Close()
 
-		// download 100k bytes before encoding
-		bufferedReader := bufio.NewReaderSize(dw, 2*1024*1024)
-		bufferedReader.Peek(100 * 1024)
+		bufferedReader := bufio.NewReaderSize(r, 2*1024*1024)
+		if magic, _ := bufferedReader.Peek(3); string(magic) == "DCA" {
+			decoder := dca.NewDecoder(bufferedReader)
+			err = decoder.ReadMetadata()
+			if err != nil {
+				log.Println("FATA: Failed reading song: ", err)
+				return
+			}
 
-		encodeSession, err = dca.EncodeMem(bufferedReader, opts)
-		if err != nil {
-			log.Println("FATA: Failed creating an encoding session: ", err)
+			if opts.Passthrough() {
+				// the frames are ready to send, no ffmpeg needed
+				source = decoder
+			} else {
+				// the volume and filters are baked into the frames, so we have to encode them again
+				ogg := dca.OggReader(decoder, decoder.Metadata.Opus.Channels)
+				defer ogg.Close()
+
+				encodeSession, err = dca.EncodeMemContext(ctx, ogg, &opts)
+				if err != nil {
+					log.Println("FATA: Failed creating an encoding session: ", err)
+				}
+			}
+		} else {
+			// songs cached before we stored dca are MP3
+			encodeSession, err = dca.EncodeMemContext(ctx, bufferedReader, &opts)
+			if err != nil {
+				log.Println("FATA: Failed creating an encoding session: ", err)
+			}
 		}
 	}
+
+	if encodeSession != nil {
+		defer encodeSession.Cleanup()
+		source = encodeSession
+	}
+	if source == nil {
+		return
+	}
+
+	player := &killableReader{OpusReader: source, cancel: cancel}
+	// sounds from /sfx are mixed in over the song
+	mixer := dca.NewMixer(ctx, player, &opts)
 	v.encoder = encodeSession
+	v.player = player
 	done := make(chan error)
-	stream := dca.NewStream(encodeSession, v.voice, done)
-	defer encodeSession.Cleanup()
+	stream := dca.NewStreamOptions(mixer, v.voice, done, streamOptions)
 	v.stream = stream
+	// /sfx flushes the stream of the mixer
+	v.mixer = mixer
+	defer func() {
+		v.mixer = nil
+	}()
+	if v.karaoke && v.lyrics != nil && song.ChannelID != "" {
+		stopLyrics := v.showLyrics(song, stream)
+		defer stopLyrics()
+	}
 
 	err = <-done
-	if err != nil && err != io.EOF {
+	if stats := stream.Stats(); stats.Underruns > 0 {
+		log.Printf("Playing %q stalled %d times for %s", song.Title, stats.Underruns, stats.Stalled)
+	}
+	if song.Source == SourcePodcast && v.positions != nil {
+		v.positions.Remember(song, song.Start+stream.PlaybackPosition(), player.Killed())
+	}
+	if verify != nil && (err == nil || err == io.EOF) {
+		// the decoder stops before the frame index, the hash needs all of it
+		if drainErr := verify.Drain(); drainErr != nil {
+			log.Println("Failed reading the rest of the cached song: ", drainErr)
+		}
+	}
+	if verify != nil && verify.Mismatch() {
+		log.Printf("Cached %s is corrupt, removing it", name)
+		v.cache.Delete(name)
+		v.index.Remove(name)
+	}
+
+	var exitErr dca.ErrFFmpegExit
+	switch {
+	case err == nil || err == io.EOF:
+	case errors.Is(err, dca.ErrKilled), errors.Is(err, dca.ErrStreamStopped):
+		// skipped or stopped, nothing went wrong
+	case errors.As(err, &exitErr):
+		log.Printf("FATA: ffmpeg crashed playing %q: %v", song.Title, exitErr)
+		return false
+	default:
 		log.Println("FATA: An error occured", err)
-		return
+		return false
 	}
-	if store && !encodeSession.Killed {
-		go func() {
-			log.Printf("Uploading %s to s3\n", name)
-			out.Close()
-			defer os.Remove(name)
-			defer os.Remove(name + ".mp3")
-			err := encodeToMP3(name)
-			if err != nil {
-				log.Println("failed encoding to mp3: ", err)
-				return
-			}
-			f, err := os.Open(name + ".mp3")
-			if err != nil {
-				log.Println("failed opening file: ", err)
-				return
-			}
-			defer f.Close()
-			err = s3.Put(name, f)
-			if err != nil {
-				log.Println("failed uploading to s3: ", err)
-				return
-			}
-			log.Printf("Uploaded %s to s3\n", name)
-		}()
-	} else if encodeSession.Killed {
-		log.Println("Not storing song as encoder got killed by user")
+
+	return stream.PlaybackPosition() > 0
+}
+
+// killableReader stops a song, also when it is not played through ffmpeg
+type killableReader struct {
+	dca.OpusReader
+	cancel context.CancelFunc // stops the encoder, if any
+
+	mutex  sync.Mutex
+	killed bool
+}
+
+func (k *killableReader) OpusFrame() ([]byte, error) {
+	if k.Killed() {
+		return nil, dca.ErrKilled
+	}
+	return k.OpusReader.OpusFrame()
+}
+
+// Kill makes the next frame the end of the song
+func (k *killableReader) Kill() {
+	k.mutex.Lock()
+	k.killed = true
+	k.mutex.Unlock()
+	if k.cancel != nil {
+		k.cancel()
 	}
 }
 
+// Killed returns true if the song was stopped by a user
+func (k *killableReader) Killed() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.killed
+}
+
 // Stop stop the audio
 func (v *VoiceInstance) Stop() {
 	v.stop = true
+	if v.player != nil {
+		v.player.Kill()
+	}
 	if v.encoder != nil {
 		v.encoder.Kill()
 	}
+	if v.stream != nil {
+		// what the stream read ahead should not play either
+		v.stream.Stop()
+	}
 }
 
 func (v *VoiceInstance) Skip() bool {
@@ -216,9 +373,15 @@ func (v *VoiceInstance) Skip() bool {
 		if v.pause {
 			return true
 		} else {
+			if v.player != nil {
+				v.player.Kill()
+			}
 			if v.encoder != nil {
 				v.encoder.Kill()
 			}
+			if v.stream != nil {
+				v.stream.Stop()
+			}
 		}
 	}
 	return false
@@ -243,47 +406,3 @@ func (v *VoiceInstance) Resume() {
 func (v *VoiceInstance) SetVolume(vl int) {
 	v.volume = int(float64(vl) / 100.0 * 256.0)
 }
-
-func encodeToMP3(file string) error {
-	args := []string{
-		"-stats",
-		"-i", file,
-		"-b:a", "320",
-		file + ".mp3",
-	}
-
-	ffmpeg := exec.Command("ffmpeg", args...)
-
-	// Starts the ffmpeg command
-	err := ffmpeg.Start()
-	if err != nil {
-		return err
-	}
-
-	return ffmpeg.Wait()
-}
-
-func downloadWithYTDLP(id string) (io.ReadCloser, error) {
-	args := []string{
-		"-o", "-",
-		"-f bestaudio",
-		id,
-	}
-
-	yt := exec.Command("yt-dlp", args...)
-	data, err := yt.StdoutPipe()
-
-	yt.Stderr = os.Stderr
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Starts the yt command
-	err = yt.Start()
-	if err != nil {
-		return nil, err
-	}
-
-	return data, nil
-}
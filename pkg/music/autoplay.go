@@ -0,0 +1,395 @@
+package music
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// autoplayWindow is how many of the last played songs autoplay will not pick again
+	autoplayWindow = 50
+	// autoplayMinWindow is the window when there is not enough history for the full one
+	autoplayMinWindow = 10
+	// autoplaySeeds is how many recently requested songs autoplay bases its picks on
+	autoplaySeeds = 5
+	// autoplayCandidates is how many related songs we ask for at once
+	autoplayCandidates = 25
+	// maxGuildHistory is how many played songs we remember per guild
+	maxGuildHistory = 500
+	// autoplayMaxFailures is how many songs in a row can fail before autoplay gives up
+	autoplayMaxFailures = 3
+)
+
+// AutoplayMode is where autoplay finds songs when the queue runs dry
+type AutoplayMode string
+
+const (
+	// AutoplayOff stops playing when the queue is empty
+	AutoplayOff AutoplayMode = ""
+	// AutoplayYouTube plays the YouTube mix of a recent song
+	AutoplayYouTube AutoplayMode = "youtube"
+	// AutoplaySpotify plays Spotify recommendations for recent songs.
+	// Spotify only gives recommendations to apps created before 27 November 2024,
+	// for newer apps this falls back to the history.
+	AutoplaySpotify AutoplayMode = "spotify"
+	// AutoplayHistory plays songs that were requested in the guild before
+	AutoplayHistory AutoplayMode = "history"
+)
+
+var errNoCandidates = errors.New("no songs to pick from")
+
+// historyStore keeps what was played in every guild in a JSON file, oldest first
+type historyStore struct {
+	mutex  sync.Mutex
+	path   string
+	guilds map[string][]Song
+}
+
+func newHistoryStore(path string) (*historyStore, error) {
+	h := &historyStore{
+		path:   path,
+		guilds: map[string][]Song{},
+	}
+
+	err := readJSONFile(path, &h.guilds)
+	if err != nil {
+		return nil, fmt.Errorf("error reading play history: %w", err)
+	}
+
+	return h, nil
+}
+
+// Add remembers a song was played in the guild
+func (h *historyStore) Add(guildID string, song Song) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// where to start is not part of the song
+	song.Start = 0
+
+	history := append(h.guilds[guildID], song)
+	if len(history) > maxGuildHistory {
+		history = history[len(history)-maxGuildHistory:]
+	}
+	h.guilds[guildID] = history
+
+	err := writeJSONFile(h.path, h.guilds)
+	if err != nil {
+		log.Println("failed saving play history: ", err)
+	}
+}
+
+// Recent returns the last n songs played in the guild, newest first
+func (h *historyStore) Recent(guildID string, n int) []Song {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	history := h.guilds[guildID]
+	out := []Song{}
+	for i := len(history) - 1; i >= 0 && len(out) < n; i-- {
+		out = append(out, history[i])
+	}
+	return out
+}
+
+// autoplayKey is how we tell songs apart for the repeat window,
+// the same song found in different places still has about the same title
+func autoplayKey(song Song) string {
+	return normalizeQuery(cleanTitle(song.Title))
+}
+
+// autoplayer picks songs when the queue runs dry
+type autoplayer struct {
+	mc      *MusicCommand
+	history *historyStore
+}
+
+// autoplayNext picks a song when the queue is empty, false if the guild does not want that
+func (v *VoiceInstance) autoplayNext() (Song, bool) {
+	if v.autoplay == nil || v.settings == nil {
+		return Song{}, false
+	}
+	return v.autoplay.next(v)
+}
+
+// next picks a song for the guild of v, false if autoplay is off or found nothing
+func (a *autoplayer) next(v *VoiceInstance) (Song, bool) {
+	mode := v.settings.Get(v.guildID).Autoplay
+	if mode == AutoplayOff {
+		return Song{}, false
+	}
+	if v.listeners() == 0 {
+		// nobody to play to
+		return Song{}, false
+	}
+
+	recent := a.history.Recent(v.guildID, autoplayWindow)
+	played := map[string]bool{}
+	seeds := []Song{}
+	for _, song := range recent {
+		played[autoplayKey(song)] = true
+		if !song.Autoplay && song.Source != SourceLive && len(seeds) < autoplaySeeds {
+			seeds = append(seeds, song)
+		}
+	}
+	if len(seeds) == 0 && len(recent) > 0 {
+		// only autoplay for a while, keep going from what it played
+		seeds = append(seeds, recent[0])
+	}
+
+	var candidates []Song
+	var err error
+	switch mode {
+	case AutoplayYouTube:
+		candidates, err = a.youtubeMix(seeds)
+	case AutoplaySpotify:
+		candidates, err = a.spotifyRecommendations(seeds)
+	}
+	if err != nil {
+		log.Printf("Autoplay from %s failed, picking from the history: %v", mode, err)
+	}
+	candidates = append(candidates, a.fromHistory(v.guildID)...)
+
+	song, err := a.pick(candidates, played)
+	if err == errNoCandidates && len(recent) > autoplayMinWindow {
+		// the guild did not play enough songs yet, allow some repeats
+		played = map[string]bool{}
+		for _, song := range recent[:autoplayMinWindow] {
+			played[autoplayKey(song)] = true
+		}
+		song, err = a.pick(a.fromHistory(v.guildID), played)
+	}
+	if err != nil {
+		log.Println("Autoplay found nothing to play: ", err)
+		return Song{}, false
+	}
+
+	song.Autoplay = true
+	song.User = ""
+	song.ID = ""
+	song.Start = 0
+	if len(recent) > 0 {
+		song.ChannelID = recent[0].ChannelID
+	}
+	return song, true
+}
+
+// pick returns the first candidate that was not played lately,
+// candidates with only a title are looked up on YouTube
+func (a *autoplayer) pick(candidates []Song, played map[string]bool) (Song, error) {
+	lookups := 0
+	for _, song := range candidates {
+		if played[autoplayKey(song)] {
+			continue
+		}
+		if song.Source != "" {
+			return song, nil
+		}
+
+		if lookups == 3 {
+			// don't search all day
+			continue
+		}
+		lookups++
+		found, err := a.mc.YoutubeFind(song.Title, "", "", nil)
+		if err != nil {
+			log.Println("Autoplay could not find a song: ", err)
+			continue
+		}
+		if played[autoplayKey(found.data)] {
+			continue
+		}
+		return found.data, nil
+	}
+
+	return Song{}, errNoCandidates
+}
+
+// youtubeMix returns the songs in the YouTube mix of the latest seed
+func (a *autoplayer) youtubeMix(seeds []Song) ([]Song, error) {
+	id := ""
+	for _, seed := range seeds {
+		if seed.Source == SourceYouTube {
+			id = seed.VidID
+			break
+		}
+	}
+	if id == "" && len(seeds) > 0 {
+		found, err := a.mc.YoutubeFind(seeds[0].Title, "", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		id = found.data.VidID
+	}
+	if id == "" {
+		return nil, errNoCandidates
+	}
+
+	entries, err := ytdlpFlatPlaylist(fmt.Sprintf("https://www.youtube.com/watch?v=%s&list=RD%s", id, id), autoplayCandidates)
+	if err != nil {
+		return nil, err
+	}
+
+	songs := []Song{}
+	for _, info := range entries {
+		info.Extractor = "Youtube"
+		song := info.song("")
+		song.Query = ""
+		songs = append(songs, song)
+	}
+	return songs, nil
+}
+
+// spotifyRecommendations asks Spotify for songs like the seeds,
+// the songs only have a title to search for. The recommendations endpoint is deprecated,
+// apps created since 27 November 2024 get a 404 from it.
+func (a *autoplayer) spotifyRecommendations(seeds []Song) ([]Song, error) {
+	ids := []string{}
+	for _, seed := range seeds {
+		result := struct {
+			Tracks struct {
+				Items []struct {
+					ID string `json:"id"`
+				} `json:"items"`
+			} `json:"tracks"`
+		}{}
+		err := a.spotifyGet("https://api.spotify.com/v1/search?type=track&limit=1&q="+url.QueryEscape(cleanTitle(seed.Title)), &result)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Tracks.Items) > 0 {
+			ids = append(ids, result.Tracks.Items[0].ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, errNoCandidates
+	}
+
+	result := struct {
+		Tracks []struct {
+			Name    string `json:"name"`
+			Artists []struct {
+				Name string `json:"name"`
+			} `json:"artists"`
+		} `json:"tracks"`
+	}{}
+	err := a.spotifyGet(fmt.Sprintf("https://api.spotify.com/v1/recommendations?limit=%d&seed_tracks=%s", autoplayCandidates, strings.Join(ids, ",")), &result)
+	if err != nil {
+		return nil, err
+	}
+
+	songs := []Song{}
+	for _, track := range result.Tracks {
+		title := track.Name
+		if len(track.Artists) > 0 {
+			title = fmt.Sprintf("%s - %s", track.Artists[0].Name, track.Name)
+		}
+		songs = append(songs, Song{Title: title})
+	}
+	return songs, nil
+}
+
+// spotifyGet calls the Spotify API and decodes the JSON it returns into out
+func (a *autoplayer) spotifyGet(link string, out interface{}) error {
+	a.mc.fetchSpotifyToken()
+
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	a.mc.SpotifyTokenMutex.Lock()
+	req.Header.Set("Authorization", "Bearer "+a.mc.SpotifyToken)
+	a.mc.SpotifyTokenMutex.Unlock()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("spotify returned %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fromHistory returns the songs people asked for in the guild before, in random order
+func (a *autoplayer) fromHistory(guildID string) []Song {
+	songs := []Song{}
+	seen := map[string]bool{}
+	for _, song := range a.history.Recent(guildID, maxGuildHistory) {
+		if song.Autoplay || song.Source == SourceLive || seen[song.CacheKey()] {
+			continue
+		}
+		seen[song.CacheKey()] = true
+		songs = append(songs, song)
+	}
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(songs), func(i, j int) {
+		songs[i], songs[j] = songs[j], songs[i]
+	})
+	return songs
+}
+
+// listeners counts the people in the voice channel with us
+func (v *VoiceInstance) listeners() int {
+	if v.session == nil || v.voice == nil {
+		return 0
+	}
+	guild, err := v.session.State.Guild(v.guildID)
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID == v.voice.ChannelID && vs.UserID != v.session.State.User.ID {
+			n++
+		}
+	}
+	return n
+}
+
+// Autoplay handles the /autoplay command
+func (mc *MusicCommand) Autoplay(i *discordgo.InteractionCreate) {
+	mode := AutoplayMode(i.ApplicationCommandData().Options[0].StringValue())
+	if mode == "off" {
+		mode = AutoplayOff
+	}
+
+	err := mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		g.Autoplay = mode
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.respondHidden(i, "I could not save that, I'm sorry :(")
+		return
+	}
+
+	content := "Autoplay is off, I'll stop when the queue is empty"
+	switch mode {
+	case AutoplayYouTube:
+		content = "When the queue is empty I'll keep going with the YouTube mix of what we played"
+	case AutoplaySpotify:
+		content = "When the queue is empty I'll keep going with what Spotify recommends"
+	case AutoplayHistory:
+		content = "When the queue is empty I'll keep going with songs this server played before"
+	}
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+		},
+	})
+}
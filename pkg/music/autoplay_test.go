@@ -0,0 +1,47 @@
+package music
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestAutoplayHistory(t *testing.T) {
+	history, err := newHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &autoplayer{history: history}
+
+	for i := 0; i < 3; i++ {
+		history.Add("guild", Song{VidID: fmt.Sprint(i), Title: fmt.Sprintf("Song %d (Official Video)", i), Source: SourceYouTube})
+	}
+	history.Add("guild", Song{VidID: "auto", Title: "Picked", Source: SourceYouTube, Autoplay: true})
+	history.Add("other", Song{VidID: "other", Title: "Other guild", Source: SourceYouTube})
+
+	recent := history.Recent("guild", 2)
+	if len(recent) != 2 || recent[0].VidID != "auto" || recent[1].VidID != "2" {
+		t.Fatalf("expected the last 2 songs newest first, got %v", recent)
+	}
+
+	if songs := a.fromHistory("guild"); len(songs) != 3 {
+		t.Errorf("expected the 3 requested songs, got %v", songs)
+	}
+
+	played := map[string]bool{
+		autoplayKey(Song{Title: "song 0"}):                  true,
+		autoplayKey(Song{Title: "Song 2 [Official Audio]"}): true,
+	}
+	song, err := a.pick(a.fromHistory("guild"), played)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if song.VidID != "1" {
+		t.Errorf("expected the song that was not played lately, got %v", song)
+	}
+
+	played[autoplayKey(song)] = true
+	if _, err := a.pick(a.fromHistory("guild"), played); err != errNoCandidates {
+		t.Errorf("expected errNoCandidates, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package music
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+)
+
+// ErrNotCached is returned when a key is not in the song cache
+var ErrNotCached = errors.New("not in cache")
+
+// CacheObject describes an entry in the song cache
+type CacheObject struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+	Metadata map[string]string // only filled in by Stat
+}
+
+// SongCache stores songs so we do not have to download them again
+type SongCache interface {
+	// Get opens a cached song, returns ErrNotCached if it is not there
+	Get(key string) (io.ReadCloser, error)
+	// Put stores a song while it is read from data, replacing any previous version.
+	// meta is kept with the song, when reading data fails nothing is stored.
+	Put(key string, data io.Reader, meta map[string]string) error
+	// Stat returns information and metadata of a cached song, returns ErrNotCached if it is not there
+	Stat(key string) (*CacheObject, error)
+	// Delete removes a song from the cache
+	Delete(key string) error
+	// List returns all cached songs
+	List() ([]*CacheObject, error)
+}
+
+// NewSongCache sets up the cache configured in the options,
+// S3 goes before a local directory, it returns nil if neither is configured.
+// Songs a local directory removes to make room are removed from index too.
+func NewSongCache(opts MusicOptions, index *CacheIndex) (SongCache, error) {
+	if opts.S3Bucket != "" {
+		return NewS3(opts.S3Endpoint, opts.S3Region, opts.S3Bucket, opts.S3Access, opts.S3Secret)
+	}
+
+	if opts.CacheDir != "" {
+		d, err := NewDirCache(opts.CacheDir, opts.CacheMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		d.OnEvict = index.Remove
+		return d, nil
+	}
+
+	log.Println("No S3 bucket or cache directory specified, not saving songs")
+	return nil, nil
+}
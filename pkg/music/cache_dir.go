@@ -0,0 +1,258 @@
+package music
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type dirEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// DirCache is a SongCache in a local directory,
+// when it grows over maxSize the least recently used songs are removed
+type DirCache struct {
+	dir     string
+	maxSize int64
+	// OnEvict is called with the key of every song removed to make room, if set
+	OnEvict func(key string)
+
+	mutex   sync.Mutex
+	entries map[string]*dirEntry
+	size    int64
+}
+
+// NewDirCache opens a cache in dir, a maxSize of 0 or less means no limit
+func NewDirCache(dir string, maxSize int64) (*DirCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	d := &DirCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[string]*dirEntry{},
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache directory: %w", err)
+	}
+	for _, f := range files {
+		key, ok := d.keyFor(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		// we do not know when it was used last before we started, the write time is close enough
+		d.entries[key] = &dirEntry{
+			size:     f.Size(),
+			lastUsed: f.ModTime(),
+		}
+		d.size += f.Size()
+	}
+
+	return d, nil
+}
+
+// pathFor returns the file a key is stored in, keys can contain a / so they get escaped
+func (d *DirCache) pathFor(key string) string {
+	return filepath.Join(d.dir, url.PathEscape(key))
+}
+
+// metaPathFor returns the sidecar file the metadata of a key is stored in,
+// it lives in a dot directory so it is never mistaken for a song
+func (d *DirCache) metaPathFor(key string) string {
+	return filepath.Join(d.dir, ".meta", url.PathEscape(key)+".json")
+}
+
+// keyFor is the reverse of pathFor, ok is false for files that are not ours
+func (d *DirCache) keyFor(name string) (string, bool) {
+	if strings.HasPrefix(name, ".") {
+		// temporary files of Put in progress
+		return "", false
+	}
+	key, err := url.PathUnescape(name)
+	return key, err == nil
+}
+
+func (d *DirCache) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.pathFor(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	if e, ok := d.entries[key]; ok {
+		e.lastUsed = time.Now()
+	}
+	d.mutex.Unlock()
+
+	return f, nil
+}
+
+func (d *DirCache) Put(key string, data io.Reader, meta map[string]string) error {
+	// write to a temporary file first so readers never see half a song
+	tmp, err := ioutil.TempFile(d.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	err = os.Rename(tmp.Name(), d.pathFor(key))
+	if err != nil {
+		d.mutex.Unlock()
+		return err
+	}
+
+	err = writeJSONFile(d.metaPathFor(key), meta)
+	if err != nil {
+		d.mutex.Unlock()
+		return fmt.Errorf("error writing metadata: %w", err)
+	}
+
+	if old, ok := d.entries[key]; ok {
+		d.size -= old.size
+	}
+	d.entries[key] = &dirEntry{
+		size:     size,
+		lastUsed: time.Now(),
+	}
+	d.size += size
+
+	evicted := d.evict(key)
+	d.mutex.Unlock()
+
+	if d.OnEvict != nil {
+		for _, key := range evicted {
+			d.OnEvict(key)
+		}
+	}
+
+	return nil
+}
+
+// evict removes the least recently used songs until we fit in maxSize again and returns their keys,
+// keep is never removed. The caller holds the mutex.
+func (d *DirCache) evict(keep string) []string {
+	evicted := []string{}
+	if d.maxSize <= 0 || d.size <= d.maxSize {
+		return evicted
+	}
+
+	keys := make([]string, 0, len(d.entries))
+	for key := range d.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return d.entries[keys[i]].lastUsed.Before(d.entries[keys[j]].lastUsed)
+	})
+
+	for _, key := range keys {
+		if d.size <= d.maxSize {
+			break
+		}
+		if key == keep {
+			continue
+		}
+
+		err := os.Remove(d.pathFor(key))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("failed evicting %s from cache: %v", key, err)
+			continue
+		}
+		os.Remove(d.metaPathFor(key))
+		d.size -= d.entries[key].size
+		delete(d.entries, key)
+		evicted = append(evicted, key)
+	}
+
+	return evicted
+}
+
+func (d *DirCache) Stat(key string) (*CacheObject, error) {
+	info, err := os.Stat(d.pathFor(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := map[string]string{}
+	err = readJSONFile(d.metaPathFor(key), &meta)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %w", err)
+	}
+
+	return &CacheObject{
+		Key:      key,
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Metadata: meta,
+	}, nil
+}
+
+func (d *DirCache) Delete(key string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	err := os.Remove(d.pathFor(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(d.metaPathFor(key))
+
+	if e, ok := d.entries[key]; ok {
+		d.size -= e.size
+		delete(d.entries, key)
+	}
+
+	return nil
+}
+
+func (d *DirCache) List() ([]*CacheObject, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []*CacheObject{}
+	for _, f := range files {
+		key, ok := d.keyFor(f.Name())
+		if !ok || f.IsDir() {
+			continue
+		}
+		out = append(out, &CacheObject{
+			Key:      key,
+			Size:     f.Size(),
+			Modified: f.ModTime(),
+		})
+	}
+
+	return out, nil
+}
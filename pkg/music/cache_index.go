@@ -0,0 +1,299 @@
+package music
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is what we know about a song in the cache
+type CacheEntry struct {
+	Key       string     `json:"key"`
+	VidID     string     `json:"vidID"`
+	Title     string     `json:"title"`
+	Duration  string     `json:"duration"`
+	Source    SongSource `json:"source"`
+	Extractor string     `json:"extractor,omitempty"`
+	URL       string     `json:"url"`
+	Thumbnail string     `json:"thumbnail,omitempty"`
+	Codec     string     `json:"codec"`
+	Loudness  float64    `json:"loudness,omitempty"` // integrated loudness in LUFS, 0 if not measured
+	SHA256    string     `json:"sha256,omitempty"`   // hex hash of the cached object, to check it when we read it
+
+	Stored     time.Time `json:"stored"`
+	Plays      int       `json:"plays"`
+	LastPlayed time.Time `json:"lastPlayed"`
+	Queries    []string  `json:"queries,omitempty"` // searches and links that found this song
+}
+
+// newCacheEntry describes a song we are about to store after playing it
+func newCacheEntry(song Song, codec string) *CacheEntry {
+	e := &CacheEntry{
+		Key:       song.CacheKey(),
+		VidID:     song.VidID,
+		Title:     song.Title,
+		Duration:  song.Duration,
+		Source:    song.Source,
+		Extractor: song.Extractor,
+		URL:       song.URL,
+		Thumbnail: song.Thumbnail,
+		Codec:     codec,
+
+		Stored:     time.Now(),
+		Plays:      1,
+		LastPlayed: time.Now(),
+	}
+	if q := normalizeQuery(song.Query); q != "" {
+		e.Queries = []string{q}
+	}
+	return e
+}
+
+// Metadata returns the entry as object metadata for the SongCache,
+// play counts change too often to keep them there
+func (e *CacheEntry) Metadata() map[string]string {
+	meta := map[string]string{
+		"vidid":    e.VidID,
+		"title":    e.Title,
+		"duration": e.Duration,
+		"source":   string(e.Source),
+		"url":      e.URL,
+		"codec":    e.Codec,
+	}
+	if e.Extractor != "" {
+		meta["extractor"] = e.Extractor
+	}
+	if e.Thumbnail != "" {
+		meta["thumbnail"] = e.Thumbnail
+	}
+	if e.Loudness != 0 {
+		meta["loudness"] = strconv.FormatFloat(e.Loudness, 'f', 1, 64)
+	}
+	return meta
+}
+
+// CacheEntryFromObject rebuilds an entry from the metadata stored with a song
+func CacheEntryFromObject(o *CacheObject) *CacheEntry {
+	loudness, _ := strconv.ParseFloat(o.Metadata["loudness"], 64)
+	return &CacheEntry{
+		Key:       o.Key,
+		VidID:     o.Metadata["vidid"],
+		Title:     o.Metadata["title"],
+		Duration:  o.Metadata["duration"],
+		Source:    SongSource(o.Metadata["source"]),
+		Extractor: o.Metadata["extractor"],
+		URL:       o.Metadata["url"],
+		Thumbnail: o.Metadata["thumbnail"],
+		Codec:     o.Metadata["codec"],
+		Loudness:  loudness,
+		Stored:    o.Modified,
+	}
+}
+
+// Song turns the entry back into a song we can queue
+func (e *CacheEntry) Song(uID, chID string) Song {
+	return Song{
+		ChannelID: chID,
+		User:      uID,
+		ID:        uID,
+		VidID:     e.VidID,
+		Title:     e.Title,
+		Duration:  e.Duration,
+		Source:    e.Source,
+		Extractor: e.Extractor,
+		URL:       e.URL,
+		Thumbnail: e.Thumbnail,
+	}
+}
+
+// CacheIndex keeps track of the songs in the cache in a JSON file
+type CacheIndex struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]*CacheEntry
+	queries map[string]string // normalized query -> key
+}
+
+// NewCacheIndex opens the index kept in path
+func NewCacheIndex(path string) (*CacheIndex, error) {
+	c := &CacheIndex{
+		path:    path,
+		entries: map[string]*CacheEntry{},
+		queries: map[string]string{},
+	}
+
+	err := readJSONFile(path, &c.entries)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cache index: %w", err)
+	}
+	for key, e := range c.entries {
+		for _, q := range e.Queries {
+			c.queries[q] = key
+		}
+	}
+
+	return c, nil
+}
+
+// normalizeQuery makes searches that only differ in case or spacing the same,
+// links are left alone as IDs in them are case sensitive
+func normalizeQuery(q string) string {
+	q = strings.Join(strings.Fields(q), " ")
+	if strings.Contains(q, "://") {
+		return q
+	}
+	return strings.ToLower(q)
+}
+
+// Get returns the entry of a key
+func (c *CacheIndex) Get(key string) (CacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return *e, true
+}
+
+// FindQuery returns the song a search or link found before
+func (c *CacheIndex) FindQuery(q string) (CacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key, ok := c.queries[normalizeQuery(q)]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	e, ok := c.entries[key]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	return *e, true
+}
+
+// Put adds or replaces an entry, the play count and queries of the old one are kept
+func (c *CacheIndex) Put(e *CacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	queries := e.Queries
+	e.Queries = nil
+	if old, ok := c.entries[e.Key]; ok {
+		e.Plays += old.Plays
+		if old.LastPlayed.After(e.LastPlayed) {
+			e.LastPlayed = old.LastPlayed
+		}
+		e.Queries = old.Queries
+	}
+	c.entries[e.Key] = e
+
+	for _, q := range queries {
+		c.addQuery(e, q)
+	}
+
+	c.save()
+}
+
+// Played counts a play of a cached song, and remembers the query that found it
+func (c *CacheIndex) Played(song Song) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[song.CacheKey()]
+	if !ok {
+		return
+	}
+	e.Plays++
+	e.LastPlayed = time.Now()
+
+	c.addQuery(e, normalizeQuery(song.Query))
+
+	c.save()
+}
+
+// addQuery remembers that q finds e, the caller holds the mutex
+func (c *CacheIndex) addQuery(e *CacheEntry, q string) {
+	if q == "" || c.queries[q] == e.Key {
+		return
+	}
+	if other, ok := c.entries[c.queries[q]]; ok {
+		// the query found another song before
+		for i, oq := range other.Queries {
+			if oq == q {
+				other.Queries = append(other.Queries[:i], other.Queries[i+1:]...)
+				break
+			}
+		}
+	}
+	c.queries[q] = e.Key
+	e.Queries = append(e.Queries, q)
+}
+
+// Remove forgets a song
+func (c *CacheIndex) Remove(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	for _, q := range e.Queries {
+		delete(c.queries, q)
+	}
+	delete(c.entries, key)
+
+	c.save()
+}
+
+// Entries returns all songs, most played first
+func (c *CacheIndex) Entries() []CacheEntry {
+	c.mutex.Lock()
+	out := make([]CacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		out = append(out, *e)
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Plays != out[j].Plays {
+			return out[i].Plays > out[j].Plays
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// Search returns the songs with all words of the query in their title, most played first
+func (c *CacheIndex) Search(query string) []CacheEntry {
+	words := strings.Fields(strings.ToLower(query))
+	out := []CacheEntry{}
+	for _, e := range c.Entries() {
+		title := strings.ToLower(e.Title)
+		match := len(words) > 0
+		for _, w := range words {
+			if !strings.Contains(title, w) {
+				match = false
+				break
+			}
+		}
+		if match {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// save writes the index to disk, the caller holds the mutex
+func (c *CacheIndex) save() {
+	err := writeJSONFile(c.path, c.entries)
+	if err != nil {
+		log.Println("failed saving cache index: ", err)
+	}
+}
@@ -0,0 +1,102 @@
+package music
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data     []byte
+	meta     map[string]string
+	modified time.Time
+}
+
+// MemoryCache is a SongCache that keeps everything in memory, meant for tests
+type MemoryCache struct {
+	mutex   sync.Mutex
+	objects map[string]memoryObject
+}
+
+// NewMemoryCache returns an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		objects: map[string]memoryObject{},
+	}
+}
+
+func (m *MemoryCache) Get(key string) (io.ReadCloser, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *MemoryCache) Put(key string, data io.Reader, meta map[string]string) error {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects[key] = memoryObject{
+		data:     b,
+		meta:     meta,
+		modified: time.Now(),
+	}
+
+	return nil
+}
+
+func (m *MemoryCache) Stat(key string) (*CacheObject, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotCached
+	}
+
+	return &CacheObject{
+		Key:      key,
+		Size:     int64(len(o.data)),
+		Modified: o.modified,
+		Metadata: o.meta,
+	}, nil
+}
+
+func (m *MemoryCache) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryCache) List() ([]*CacheObject, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := []*CacheObject{}
+	for key, o := range m.objects {
+		out = append(out, &CacheObject{
+			Key:      key,
+			Size:     int64(len(o.data)),
+			Modified: o.modified,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+
+	return out, nil
+}
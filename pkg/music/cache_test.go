@@ -0,0 +1,429 @@
+package music
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// testSongCache puts a song in c and reads it back
+func testSongCache(t *testing.T, c SongCache) {
+	t.Helper()
+
+	if _, err := c.Get("youtube/abc"); err != ErrNotCached {
+		t.Errorf("expected ErrNotCached, got %v", err)
+	}
+
+	err := c.Put("youtube/abc", strings.NewReader("a song"), map[string]string{"title": "A Song"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Get("youtube/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "a song" {
+		t.Errorf("got %q from the cache", data)
+	}
+
+	o, err := c.Stat("youtube/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Key != "youtube/abc" || o.Size != 6 {
+		t.Errorf("got %s of %d bytes", o.Key, o.Size)
+	}
+	if o.Metadata["title"] != "A Song" {
+		t.Errorf("expected the title in the metadata, got %v", o.Metadata)
+	}
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Key != "youtube/abc" {
+		t.Errorf("expected only youtube/abc in the cache, got %v", list)
+	}
+
+	err = c.Delete("youtube/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat("youtube/abc"); err != ErrNotCached {
+		t.Errorf("expected ErrNotCached after delete, got %v", err)
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	d, err := NewDirCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSongCache(t, d)
+}
+
+func TestMemoryCache(t *testing.T) {
+	testSongCache(t, NewMemoryCache())
+}
+
+func TestDirCachePutAborted(t *testing.T) {
+	d, err := NewDirCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("half a song"))
+		pw.CloseWithError(errors.New("stopped"))
+	}()
+
+	err = d.Put("youtube/abc", pr, nil)
+	if err == nil {
+		t.Fatal("expected an error from an aborted put")
+	}
+
+	_, err = d.Get("youtube/abc")
+	if err != ErrNotCached {
+		t.Errorf("expected ErrNotCached, got %v", err)
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected an empty cache, got %d songs", len(list))
+	}
+}
+
+func TestDirCacheEvict(t *testing.T) {
+	d, err := NewDirCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		err = d.Put(key, strings.NewReader("12345"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// playing a makes b the least recently used
+	r, err := d.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "12345" {
+		t.Errorf("got %q from the cache", data)
+	}
+
+	evicted := []string{}
+	d.OnEvict = func(key string) {
+		evicted = append(evicted, key)
+	}
+	err = d.Put("c", strings.NewReader("12345"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Stat("b"); err != ErrNotCached {
+		t.Errorf("expected b to be evicted, got %v", err)
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("expected OnEvict to be called for b, got %v", evicted)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := d.Stat(key); err != nil {
+			t.Errorf("expected %s to be cached, got %v", key, err)
+		}
+	}
+}
+
+func TestCacheIndexQueries(t *testing.T) {
+	index, err := NewCacheIndex(t.TempDir() + "/cache.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	song := Song{
+		VidID:  "dQw4w9WgXcQ",
+		Title:  "Rick Astley - Never Gonna Give You Up",
+		Source: SourceYouTube,
+		Query:  "Never  gonna give you UP",
+	}
+	index.Put(newCacheEntry(song, "dca"))
+
+	entry, ok := index.FindQuery("never gonna give you up")
+	if !ok {
+		t.Fatal("query not found")
+	}
+	if entry.Key != "dQw4w9WgXcQ" || entry.Plays != 1 {
+		t.Errorf("got %s with %d plays", entry.Key, entry.Plays)
+	}
+
+	song.Query = "https://youtu.be/dQw4w9WgXcQ"
+	index.Played(song)
+
+	if _, ok := index.FindQuery("https://youtu.be/dqw4w9wgxcq"); ok {
+		t.Error("links should be case sensitive")
+	}
+	entry, ok = index.FindQuery("https://youtu.be/dQw4w9WgXcQ")
+	if !ok {
+		t.Fatal("link not found")
+	}
+	if entry.Plays != 2 {
+		t.Errorf("expected 2 plays, got %d", entry.Plays)
+	}
+
+	// a new index reads back what we saved
+	index, err = NewCacheIndex(index.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.FindQuery("never gonna give you up"); !ok {
+		t.Error("query not found after reopening the index")
+	}
+}
+
+func TestHashReader(t *testing.T) {
+	tests := map[string]bool{
+		"": false, // not checked
+		"3bea44f95b17af14e750df7ab567b80b5e9aaaab87c2b4c1204f2269f98af653": false, // sha256 of "disco"
+		"3bea44f95b17af14e750df7ab567b80b5e9aaaab87c2b4c1204f2269f98af654": true,
+	}
+
+	for expected, mismatch := range tests {
+		h := newHashReader(strings.NewReader("disco"), expected)
+		ioutil.ReadAll(h)
+		if h.Mismatch() != mismatch {
+			t.Errorf("mismatch %v for expected hash %q", h.Mismatch(), expected)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, d := range []time.Duration{0, 59 * time.Second, 3*time.Minute + 5*time.Second, 26*time.Hour + 3*time.Second} {
+		got := parseDuration(formatDuration(int(d.Seconds())))
+		if got != d {
+			t.Errorf("parseDuration(formatDuration(%s)) = %s", d, got)
+		}
+	}
+}
+
+func TestFlightReaders(t *testing.T) {
+	f := newFlight("youtube/abc")
+	if f.file == nil {
+		t.Fatal(f.err)
+	}
+	spill := f.file.Name()
+
+	first := f.newReader()
+	f.Write([]byte("dis"))
+	// someone joining halfway still gets the whole song
+	second := f.newReader()
+
+	go func() {
+		f.Write([]byte("co"))
+		f.finishReading(io.EOF)
+	}()
+
+	for _, r := range []*flightReader{first, second} {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "disco" {
+			t.Errorf("expected disco, got %q", got)
+		}
+	}
+
+	third := f.newReader()
+	first.Close()
+	second.Close()
+	select {
+	case <-f.cancel:
+		t.Fatal("canceled while someone is still listening")
+	default:
+	}
+	third.Close()
+
+	// a finished download is not canceled
+	select {
+	case <-f.cancel:
+		t.Fatal("canceled a finished download")
+	default:
+	}
+	if _, err := os.Stat(spill); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestFlightCancel(t *testing.T) {
+	f := newFlight("youtube/abc")
+	defer f.finishReading(errSongKilled)
+
+	r := f.newReader()
+	read := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 8))
+		read <- err
+	}()
+
+	r.Close()
+	if err := <-read; err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe, got %v", err)
+	}
+	select {
+	case <-f.cancel:
+	default:
+		t.Fatal("expected the download to be canceled when nobody listens")
+	}
+}
+
+func TestVerifyIndexedSong(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := dca.NewIndexedWriter(&buf, dca.NewMetadata(dca.StdEncodeOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		w.WriteFrame([]byte{0xFC, byte(i)})
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+
+	cache := NewMemoryCache()
+	index, err := NewCacheIndex(t.TempDir() + "/cache.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Put("abc", bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the frame index at the end has to be hashed too
+	index.Put(&CacheEntry{Key: "abc", SHA256: hex.EncodeToString(sum[:])})
+	if err := VerifyCachedSong(cache, index, "abc"); err != nil {
+		t.Errorf("expected a good song, got %v", err)
+	}
+
+	index.Put(&CacheEntry{Key: "abc", SHA256: "0000"})
+	if err := VerifyCachedSong(cache, index, "abc"); err == nil {
+		t.Error("expected a wrong hash to be rejected")
+	}
+}
+
+// fakeYTDLP puts a script named yt-dlp first in the PATH that writes the file at path
+func fakeYTDLP(t *testing.T, path string) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "yt-dlp"), []byte("#!/bin/sh\ncat '"+path+"'\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	t.Cleanup(func() {
+		os.Setenv("PATH", oldPath)
+	})
+}
+
+func TestStoreSongPassthrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as yt-dlp")
+	}
+
+	// YouTube has Ogg or WebM opus, which goes in the cache without ffmpeg
+	file, err := os.Open("../dca/testaudio.dca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var ogg bytes.Buffer
+	o, err := dca.NewOggWriter(&ogg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := dca.NewDecoder(file)
+	frames := 0
+	for {
+		frame, err := decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.WriteFrame(frame)
+		frames++
+	}
+	o.Close()
+
+	song := filepath.Join(t.TempDir(), "song.opus")
+	err = ioutil.WriteFile(song, ogg.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeYTDLP(t, song)
+
+	cache := NewMemoryCache()
+	index, err := NewCacheIndex(t.TempDir() + "/cache.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = StoreSong(cache, index, Song{VidID: "abc", Title: "A Song", Source: SourceYouTube})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, ok := index.Get("abc")
+	if !ok || entry.SHA256 == "" || entry.Loudness != 0 {
+		t.Errorf("expected the song in the index without a loudness, got %+v", entry)
+	}
+	if err := VerifyCachedSong(cache, index, "abc"); err != nil {
+		t.Errorf("expected the stored song to check out, got %v", err)
+	}
+
+	r, err := cache.Get("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stored := dca.NewDecoder(r)
+	got := 0
+	for {
+		_, err := stored.OpusFrame()
+		if err != nil {
+			break
+		}
+		got++
+	}
+	if got != frames {
+		t.Errorf("expected %d frames in the cache, got %d", frames, got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -20,7 +21,22 @@ type MusicCommand struct {
 	mutex          sync.Mutex
 	songSignal     chan PkgSong
 
-	opts MusicOptions
+	opts      MusicOptions
+	settings  *settingsStore
+	positions *positionStore
+	library   *Library
+	cache     SongCache
+	index     *CacheIndex
+	downloads *downloads
+	tts       TTSEngine
+	lyrics    LyricsProvider
+	history   *historyStore
+	autoplay  *autoplayer
+
+	recordings *S3 // bucket to upload recordings to, nil to disable /record
+
+	podcastMutex sync.Mutex
+	podcastMenus map[string]*podcastMenu
 
 	SpotifyTokenMutex sync.Mutex
 	SpotifyToken      string
@@ -33,21 +49,109 @@ type MusicOptions struct {
 	S3Secret     string
 	S3Region     string
 	S3Endpoint   string
+
+	CacheDir     string // local directory to cache songs in when there is no S3 bucket
+	CacheMaxSize int64  // max size in bytes of CacheDir, 0 for no limit
+
+	MaxFileSize     int64         // max size in bytes of audio files we play directly
+	MaxFileDuration time.Duration // max duration of audio files we play directly
+
+	DataDir      string            // where we keep guild settings, podcast positions and the library index
+	RadioPresets map[string]string // stations every guild can play by name
+	Sounds       map[string]string // clips every guild can play with /sfx, name to file or url
+
+	LibraryDir    string        // directory of local audio files to index, empty to disable
+	LibraryRescan time.Duration // how often to look for new files in the library
+
+	TTS string // engine to announce songs with, see NewTTSEngine, empty to disable
+
+	LyricsAPI string // LRCLIB compatible API to find lyrics with, empty to only use .lrc files in the library
 }
 
 func NewMusicCommand(dg *discordgo.Session, opts MusicOptions) (*MusicCommand, error) {
+	settings, err := newSettingsStore(filepath.Join(opts.DataDir, "guilds.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	positions, err := newPositionStore(filepath.Join(opts.DataDir, "podcasts.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := NewCacheIndex(filepath.Join(opts.DataDir, "cache.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewSongCache(opts, index)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up the song cache: %w", err)
+	}
+
+	var library *Library
+	if opts.LibraryDir != "" {
+		library, err = NewLibrary(opts.LibraryDir, filepath.Join(opts.DataDir, "library.json"))
+		if err != nil {
+			return nil, err
+		}
+		go library.Watch(opts.LibraryRescan)
+	}
+
+	var tts TTSEngine
+	if opts.TTS != "" {
+		tts, err = NewTTSEngine(opts.TTS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lyrics := LyricsProviders{LRCFiles{}}
+	if opts.LyricsAPI != "" {
+		api, err := NewLyricsCache(LRCLib(opts.LyricsAPI), filepath.Join(opts.DataDir, "lyrics.json"))
+		if err != nil {
+			return nil, err
+		}
+		lyrics = append(lyrics, api)
+	}
+
+	history, err := newHistoryStore(filepath.Join(opts.DataDir, "history.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// recordings only go to S3, a local cache directory is not reachable by link
+	recordings, _ := cache.(*S3)
+
 	songSignal := make(chan PkgSong)
 	go GlobalPlay(songSignal)
 
-	return &MusicCommand{
+	mc := &MusicCommand{
 		dg:             dg,
 		voiceInstances: map[string]*VoiceInstance{},
 		songSignal:     songSignal,
 		opts:           opts,
-	}, nil
+		settings:       settings,
+		positions:      positions,
+		library:        library,
+		cache:          cache,
+		index:          index,
+		downloads:      newDownloads(cache, index),
+		tts:            tts,
+		lyrics:         lyrics,
+		recordings:     recordings,
+		history:        history,
+		podcastMenus:   map[string]*podcastMenu{},
+	}
+	mc.autoplay = &autoplayer{mc: mc, history: history}
+
+	return mc, nil
 }
 
 func (m *MusicCommand) Register() {
+	m.dg.AddHandler(m.handleRawInteraction)
+	// people joining a recorded voice channel have to know
+	m.dg.AddHandler(m.onVoiceStateUpdate)
 	m.dg.AddHandler(func(sess *discordgo.Session, i *discordgo.InteractionCreate) {
 		if i.Type == discordgo.InteractionApplicationCommand {
 			if i.ApplicationCommandData().Name == "join" {
@@ -66,6 +170,28 @@ func (m *MusicCommand) Register() {
 				m.Volume(i)
 			} else if i.ApplicationCommandData().Name == "playlist" {
 				m.Playlist(i)
+			} else if i.ApplicationCommandData().Name == "radio" {
+				m.Radio(i)
+			} else if i.ApplicationCommandData().Name == "podcast" {
+				m.Podcast(i)
+			} else if i.ApplicationCommandData().Name == "library" {
+				m.Library(i)
+			} else if i.ApplicationCommandData().Name == "sfx" {
+				m.Sfx(i)
+			} else if i.ApplicationCommandData().Name == "autoplay" {
+				m.Autoplay(i)
+			} else if i.ApplicationCommandData().Name == "lyrics" {
+				m.Lyrics(i)
+			} else if i.ApplicationCommandData().Name == "karaoke" {
+				m.Karaoke(i)
+			} else if i.ApplicationCommandData().Name == "record" {
+				m.Record(i)
+			} else if i.ApplicationCommandData().Name == "announce" {
+				m.Announce(i)
+			}
+		} else if i.Type == discordgo.InteractionMessageComponent {
+			if strings.HasPrefix(i.MessageComponentData().CustomID, "podcast:") {
+				m.PodcastEpisode(i)
 			}
 		}
 	})
@@ -98,7 +224,23 @@ func (m *MusicCommand) InstallSlashCommands(session *discordgo.Session) error {
 			{
 				Type:        discordgo.ApplicationCommandOptionString,
 				Name:        "query",
-				Description: "query for song, can be a youtube URL or text query",
+				Description: "query for song, can be a text query or a link to YouTube, SoundCloud, Bandcamp...",
+				Required:    true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "playfile",
+		Description: "Play an uploaded audio file",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        applicationCommandOptionAttachment,
+				Name:        "file",
+				Description: "mp3, flac, ogg... file to play",
 				Required:    true,
 			},
 		},
@@ -175,6 +317,263 @@ func (m *MusicCommand) InstallSlashCommands(session *discordgo.Session) error {
 		return err
 	}
 
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "radio",
+		Description: "Tune in to an internet radio station",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "play",
+				Description: "Play a radio station",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "station",
+						Description: "Stream link (Icecast, Shoutcast, HLS) or the name of a preset",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List the radio presets",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "add",
+				Description: "Add a radio preset to this server",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Short name of the station",
+						Required:    true,
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "url",
+						Description: "Stream link of the station",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a radio preset from this server",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Short name of the station",
+						Required:    true,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "podcast",
+		Description: "Listen to a podcast, picking up where you left",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "feed",
+				Description: "Link to the RSS or Atom feed of the podcast",
+				Required:    true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "sfx",
+		Description: "Play a sound over the music",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "name",
+				Description: "Name of the sound, see /soundboard list",
+				Required:    true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "soundboard",
+		Description: "Manage the sounds for /sfx",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List the sounds",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "add",
+				Description: "Add a sound to this server",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Short name of the sound",
+						Required:    true,
+					},
+					{
+						Type:        applicationCommandOptionAttachment,
+						Name:        "file",
+						Description: "Audio file of at most 15 seconds",
+						Required:    true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a sound from this server",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionString,
+						Name:        "name",
+						Description: "Short name of the sound",
+						Required:    true,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if m.tts != nil {
+		err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+			Name:        "announce",
+			Description: "Announce every song before it plays",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enabled",
+					Description: "Announce songs or not",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "language",
+					Description: "Language of the voice, like en, nl or de",
+					Required:    false,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "autoplay",
+		Description: "Keep the music going with related songs when the queue is empty",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "mode",
+				Description: "where to find the songs",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "off", Value: "off"},
+					{Name: "YouTube mix", Value: string(AutoplayYouTube)},
+					{Name: "Spotify recommendations", Value: string(AutoplaySpotify)},
+					{Name: "this server's history", Value: string(AutoplayHistory)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "lyrics",
+		Description: "Show the lyrics of the song that is playing, or any other song",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "query",
+				Description: "song to look up, the one playing if empty",
+				Required:    false,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+		Name:        "karaoke",
+		Description: "Take the vocals out of the music and sing along with the lyrics",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "enabled",
+				Description: "Karaoke or not",
+				Required:    true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if m.recordings != nil {
+		err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+			Name:        "record",
+			Description: "Record the voice channel, everyone in it is told",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "start",
+					Description: "Start recording everyone in the voice channel",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "stop",
+					Description: "Stop recording and post the links",
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.library != nil {
+		err = slash.InstallSlashCommand(session, "", discordgo.ApplicationCommand{
+			Name:        "library",
+			Description: "Play a song from our own record collection",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "query",
+					Description: "title, artist or album to look for",
+					Required:    true,
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -211,6 +610,15 @@ func (mc *MusicCommand) Join(i *discordgo.InteractionCreate, doNotReply bool) er
 		mc.voiceInstances[i.GuildID] = v
 		v.guildID = i.GuildID
 		v.session = mc.dg
+		v.positions = mc.positions
+		v.cache = mc.cache
+		v.index = mc.index
+		v.downloads = mc.downloads
+		v.settings = mc.settings
+		v.tts = mc.tts
+		v.lyrics = mc.lyrics
+		v.history = mc.history
+		v.autoplay = mc.autoplay
 		mc.mutex.Unlock()
 	}
 	var err error
@@ -250,6 +658,14 @@ func (mc *MusicCommand) Leave(i *discordgo.InteractionCreate) {
 		return
 	}
 	v.Stop()
+	if v.Recording() {
+		go func() {
+			content, err := mc.finishRecording(v)
+			if err == nil {
+				mc.dg.ChannelMessageSend(i.ChannelID, content)
+			}
+		}()
+	}
 	time.Sleep(200 * time.Millisecond)
 	v.voice.Disconnect()
 	log.Println("INFO: Voice channel destroyed")
@@ -298,10 +714,26 @@ func (mc *MusicCommand) Play(i *discordgo.InteractionCreate) {
 		})
 		return
 	}
-	// send play my_song_youtube
-	song, err := mc.YoutubeFind(query, i.Member.User.ID, i.ChannelID, v)
+	var song PkgSong
+	var err error
+	if isAudioFileURL(query) {
+		song, err = mc.FileFind(query, "", 0, i.Member.User.ID, i.ChannelID, v)
+		if err != nil {
+			log.Println("ERROR: File probe: ", err)
+			mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+				Content: mc.fileErrorMessage(err),
+			})
+			return
+		}
+	} else if isDirectURL(query) {
+		// SoundCloud, Bandcamp, Vimeo... let yt-dlp figure it out
+		song, err = mc.YTDLPFind(query, i.Member.User.ID, i.ChannelID, v)
+	} else {
+		// send play my_song_youtube
+		song, err = mc.YoutubeFind(query, i.Member.User.ID, i.ChannelID, v)
+	}
 	if err != nil || song.data.ID == "" {
-		log.Println("ERROR: Youtube search: ", err)
+		log.Println("ERROR: Song search: ", err)
 		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
 			Content: "I do not know how to groove to that song...",
 		})
@@ -490,6 +922,13 @@ func (mc *MusicCommand) Playlist(i *discordgo.InteractionCreate) {
 	})
 }
 
+// voiceInstance returns the voice instance of a guild, nil if we are not in voice there
+func (mc *MusicCommand) voiceInstance(guildID string) *VoiceInstance {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.voiceInstances[guildID]
+}
+
 func (mc *MusicCommand) CheckVC(i *discordgo.InteractionCreate, reply bool) *VoiceInstance {
 	v := mc.voiceInstances[i.GuildID]
 	if v == nil && reply {
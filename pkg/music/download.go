@@ -0,0 +1,369 @@
+package music
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// cacheBitrate is the bitrate in kbps songs are encoded at, they are cached once for every guild.
+// It is about what the opus on YouTube has, which is passed through as it is.
+const cacheBitrate = 128
+
+// downloads makes sure a song is only downloaded and encoded once at a time,
+// everyone who wants to play it while that runs reads along
+type downloads struct {
+	cache    SongCache // nil to not store anything
+	index    *CacheIndex
+	unplayed bool // store songs without counting a play, for prewarming
+
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+func newDownloads(cache SongCache, index *CacheIndex) *downloads {
+	return &downloads{
+		cache:   cache,
+		index:   index,
+		flights: map[string]*flight{},
+	}
+}
+
+// Open returns the song as dca at the default volume, starting a download if nobody is downloading it yet
+func (d *downloads) Open(song Song) *flightReader {
+	key := song.CacheKey()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	f, ok := d.flights[key]
+	if ok && !f.joinable() {
+		// everyone stopped listening just now, it is not coming back
+		ok = false
+	}
+	if !ok {
+		f = newFlight(key)
+		if f.file == nil {
+			// the reader gets why there is nowhere to keep the song
+			return f.newReader()
+		}
+		d.flights[key] = f
+		go d.run(f, song)
+	} else {
+		log.Printf("Already downloading %s, listening along", key)
+	}
+
+	return f.newReader()
+}
+
+// run downloads and encodes the song into the flight and the cache
+func (d *downloads) run(f *flight, song Song) {
+	defer func() {
+		d.mutex.Lock()
+		if d.flights[f.key] == f {
+			delete(d.flights, f.key)
+		}
+		d.mutex.Unlock()
+	}()
+
+	opts := *dca.StdEncodeOptions
+	opts.RawOutput = true
+	opts.Bitrate = cacheBitrate
+	opts.Application = "lowdelay"
+	// measure the loudness to keep it in the cache index
+	opts.Loudness = d.cache != nil
+
+	dw, err := downloadWithYTDLP(song.StreamURL())
+	if err != nil {
+		f.finish(err, err)
+		return
+	}
+	defer dw.Close()
+
+	// download 100k bytes before encoding
+	bufferedReader := bufio.NewReaderSize(dw, 2*1024*1024)
+	bufferedReader.Peek(100 * 1024)
+
+	// stop ffmpeg as soon as everyone stopped listening
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-f.cancel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// youtube mostly has opus already, which we can keep as it is
+	source, encodeSession, err := dca.DemuxOrEncodeContext(ctx, bufferedReader, &opts)
+	if err != nil {
+		f.finish(err, err)
+		return
+	}
+	if encodeSession != nil {
+		defer encodeSession.Cleanup()
+	} else {
+		log.Printf("Passing the opus of %s through", f.key)
+	}
+
+	out := []io.Writer{f}
+	sum := sha256.New()
+	var upload *io.PipeWriter
+	uploaded := make(chan error, 1)
+	entry := newCacheEntry(song, "dca")
+	if d.unplayed {
+		entry.Plays = 0
+		entry.LastPlayed = time.Time{}
+	}
+	if d.cache != nil {
+		var pr *io.PipeReader
+		pr, upload = io.Pipe()
+		go func() {
+			log.Printf("Storing %s in the cache\n", f.key)
+			err := d.cache.Put(f.key, pr, entry.Metadata())
+			// keep reading if the cache gave up, so the song keeps playing
+			io.Copy(ioutil.Discard, pr)
+			uploaded <- err
+		}()
+		out = append(out, upload, sum)
+	}
+
+	// the frame index lets us start cached songs halfway without ffmpeg
+	w, err := dca.NewIndexedWriter(io.MultiWriter(out...), dca.NewMetadata(&opts))
+	if err != nil {
+		if upload != nil {
+			upload.CloseWithError(err)
+			<-uploaded
+		}
+		f.finish(err, err)
+		return
+	}
+
+	frames := 0
+	for ctx.Err() == nil {
+		var frame []byte
+		frame, err = source.OpusFrame()
+		if err != nil {
+			break
+		}
+		err = w.WriteFrame(frame)
+		if err != nil {
+			break
+		}
+		frames++
+	}
+
+	switch {
+	case ctx.Err() != nil || errors.Is(err, dca.ErrKilled):
+		log.Println("Not storing song as everyone stopped listening")
+		err = errSongKilled
+	case err != io.EOF:
+	case frames == 0:
+		err = errors.New("no audio")
+	default:
+		err = checkEncode(song, dw, source)
+		if err != nil {
+			log.Println("Not storing incomplete song: ", err)
+		} else {
+			err = w.Close()
+		}
+	}
+
+	// the listeners got everything we have, an incomplete song just ends early for them
+	playErr := err
+	if playErr != errSongKilled {
+		playErr = io.EOF
+	}
+
+	if upload == nil {
+		f.finish(playErr, err)
+		return
+	}
+
+	if err != nil {
+		upload.CloseWithError(err)
+	} else {
+		upload.Close()
+	}
+	// listeners can finish the song while the upload completes
+	f.finishReading(playErr)
+
+	storeErr := <-uploaded
+	if err == nil && storeErr != nil {
+		err = storeErr
+	}
+	if err != nil {
+		log.Printf("Did not store %s in the cache: %v", f.key, err)
+	} else {
+		log.Printf("Stored %s in the cache\n", f.key)
+		entry.SHA256 = hex.EncodeToString(sum.Sum(nil))
+		// opus that was passed through was not measured by ffmpeg
+		if encodeSession != nil {
+			if lufs, ok := encodeSession.Loudness(); ok {
+				entry.Loudness = lufs
+			}
+		}
+		d.index.Put(entry)
+	}
+	f.finishStoring(err)
+}
+
+// flight is a song being downloaded, the dca is kept in a temporary file for everyone reading along
+type flight struct {
+	key string
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	file    *os.File // nil once the song is complete and nobody reads it anymore
+	size    int64
+	readers int
+	done    bool
+	err     error // io.EOF when the song is complete
+
+	cancel   chan struct{}
+	canceled bool
+
+	stored   chan struct{}
+	storeErr error
+}
+
+// newFlight creates a flight for the song with key, if there is no room for a temporary file
+// the flight is finished with the error
+func newFlight(key string) *flight {
+	f := &flight{
+		key:    key,
+		cancel: make(chan struct{}),
+		stored: make(chan struct{}),
+	}
+	f.cond = sync.NewCond(&f.mutex)
+
+	file, err := ioutil.TempFile("", "disco-download-*")
+	if err != nil {
+		f.finish(err, err)
+		return f
+	}
+	f.file = file
+	return f
+}
+
+// Write adds encoded data and wakes up the readers
+func (f *flight) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	f.mutex.Unlock()
+	f.cond.Broadcast()
+	return n, err
+}
+
+func (f *flight) finishReading(err error) {
+	f.mutex.Lock()
+	f.done = true
+	f.err = err
+	f.release()
+	f.mutex.Unlock()
+	f.cond.Broadcast()
+}
+
+// release removes the temporary file once the song is complete and nobody reads it anymore,
+// f must be locked
+func (f *flight) release() {
+	if !f.done || f.readers > 0 || f.file == nil {
+		return
+	}
+	f.file.Close()
+	os.Remove(f.file.Name())
+	f.file = nil
+}
+
+func (f *flight) finishStoring(err error) {
+	f.storeErr = err
+	close(f.stored)
+}
+
+func (f *flight) finish(readErr, storeErr error) {
+	f.finishReading(readErr)
+	f.finishStoring(storeErr)
+}
+
+// joinable returns true if a new reader can still read the song from the start
+func (f *flight) joinable() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return !f.canceled && f.file != nil
+}
+
+func (f *flight) newReader() *flightReader {
+	f.mutex.Lock()
+	f.readers++
+	f.mutex.Unlock()
+	return &flightReader{f: f}
+}
+
+// flightReader reads a flight from the start, at its own pace
+type flightReader struct {
+	f      *flight
+	pos    int64
+	closed bool
+}
+
+func (r *flightReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for r.pos >= f.size && !f.done && !r.closed {
+		f.cond.Wait()
+	}
+
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if r.pos < f.size {
+		if left := f.size - r.pos; int64(len(p)) > left {
+			p = p[:left]
+		}
+		n, err := f.file.ReadAt(p, r.pos)
+		r.pos += int64(n)
+		return n, err
+	}
+	return 0, f.err
+}
+
+// Close stops reading along, the download is canceled when nobody is left
+func (r *flightReader) Close() error {
+	f := r.f
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	f.readers--
+	if f.readers == 0 && !f.done && !f.canceled {
+		f.canceled = true
+		close(f.cancel)
+	}
+	f.release()
+	f.cond.Broadcast()
+
+	return nil
+}
+
+// Stored waits until the song is in the cache, or returns why it is not
+func (r *flightReader) Stored() error {
+	<-r.f.stored
+	return r.f.storeErr
+}
@@ -0,0 +1,228 @@
+package music
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// applicationCommandOptionAttachment is the attachment option type, our discordgo fork doesn't know it yet
+const applicationCommandOptionAttachment discordgo.ApplicationCommandOptionType = 11
+
+var (
+	errFileTooLarge    = errors.New("file too large")
+	errFileTooLong     = errors.New("file too long")
+	errFileSizeUnknown = errors.New("file size unknown")
+	errFileNoLength    = errors.New("file has no length")
+)
+
+// fileClient fetches the files and playlists people link to, a server that does not answer should not hold up a command
+var fileClient = &http.Client{Timeout: 10 * time.Second}
+
+// audioFileExtensions are the files we play directly with ffmpeg instead of asking yt-dlp
+var audioFileExtensions = map[string]bool{
+	".mp3":  true,
+	".flac": true,
+	".ogg":  true,
+	".oga":  true,
+	".opus": true,
+	".wav":  true,
+	".m4a":  true,
+	".aac":  true,
+}
+
+// isAudioFileURL returns true if the query is a http(s) link to an audio file
+func isAudioFileURL(query string) bool {
+	u, err := url.Parse(query)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return audioFileExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+// FileFind checks the limits of an audio file and fills in the song from its tags.
+// size is the size in bytes if known, 0 will make us ask the server.
+func (m *MusicCommand) FileFind(link, fileName string, size int64, uID, chID string, v *VoiceInstance) (song_struct PkgSong, err error) {
+	if size <= 0 {
+		resp, err := fileClient.Head(link)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				size = resp.ContentLength
+			}
+		}
+	}
+	if m.opts.MaxFileSize > 0 && size <= 0 {
+		// it could be any size
+		err = errFileSizeUnknown
+		return
+	}
+	if m.opts.MaxFileSize > 0 && size > m.opts.MaxFileSize {
+		err = errFileTooLarge
+		return
+	}
+
+	probe, err := dca.Probe(link)
+	if err != nil {
+		err = fmt.Errorf("error probing file: %w", err)
+		return
+	}
+
+	length := probe.Format.ParsedDuration()
+	if length <= 0 {
+		// a stream or not audio at all
+		err = errFileNoLength
+		return
+	}
+	if m.opts.MaxFileDuration > 0 && length > m.opts.MaxFileDuration {
+		err = errFileTooLong
+		return
+	}
+
+	if fileName == "" {
+		u, _ := url.Parse(link)
+		fileName = path.Base(u.Path)
+	}
+
+	title := fileName
+	tags := probe.Format.Tags
+	if tags.Title != "" {
+		title = tags.Title
+		if tags.Artist != "" {
+			title = fmt.Sprintf("%s - %s", tags.Artist, tags.Title)
+		}
+	}
+
+	song_struct.data = Song{
+		ChannelID: chID,
+		User:      uID,
+		ID:        uID,
+		VidID:     fileName,
+		Title:     title,
+		Duration:  formatDuration(int(length.Seconds())),
+		Source:    SourceFile,
+		URL:       link,
+	}
+	song_struct.v = v
+
+	return
+}
+
+// fileErrorMessage turns an error from FileFind into something to tell the user
+func (m *MusicCommand) fileErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, errFileTooLarge):
+		return fmt.Sprintf("That file is too big for me, I can only take up to %d MB", m.opts.MaxFileSize/1024/1024)
+	case errors.Is(err, errFileTooLong):
+		return fmt.Sprintf("That track is longer than my dance stamina of %s", m.opts.MaxFileDuration)
+	case errors.Is(err, errFileSizeUnknown):
+		return "That server won't tell me how big the file is, so I can't play it"
+	case errors.Is(err, errFileNoLength):
+		return "I can't tell how long that file is, for streams try /radio"
+	}
+	return "I do not know how to groove to that file..."
+}
+
+// rawCommandData is the part of the interaction we need but our discordgo fork drops
+type rawCommandData struct {
+	Data struct {
+		Name     string `json:"name"`
+		Resolved struct {
+			Attachments map[string]*discordgo.MessageAttachment `json:"attachments"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+// handleRawInteraction looks at the raw event to find resolved attachments
+func (m *MusicCommand) handleRawInteraction(sess *discordgo.Session, e *discordgo.Event) {
+	if e.Type != "INTERACTION_CREATE" {
+		return
+	}
+	i, ok := e.Struct.(*discordgo.InteractionCreate)
+	if !ok || i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	data := rawCommandData{}
+	err := json.Unmarshal(e.RawData, &data)
+	if err != nil || (data.Data.Name != "playfile" && data.Data.Name != "soundboard") {
+		return
+	}
+
+	var attachment *discordgo.MessageAttachment
+	for _, a := range data.Data.Resolved.Attachments {
+		attachment = a
+	}
+
+	if data.Data.Name == "soundboard" {
+		m.Soundboard(i, attachment)
+		return
+	}
+	m.PlayFile(i, attachment)
+}
+
+// PlayFile plays an uploaded audio file
+func (mc *MusicCommand) PlayFile(i *discordgo.InteractionCreate, attachment *discordgo.MessageAttachment) {
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	v := mc.CheckVC(i, false)
+	if v == nil {
+		err := mc.Join(i, true)
+		if err != nil {
+			mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+				Content: err.Error(),
+			})
+		}
+		v = mc.CheckVC(i, true)
+		if v == nil { // try twice
+			return
+		}
+	}
+
+	if attachment == nil {
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "You need to give me a file to play!",
+		})
+		return
+	}
+
+	// if the user is not a voice channel not accept the command
+	voiceChannelID := mc.SearchVoiceChannel(i.Member.User.ID)
+	if v.voice.ChannelID != voiceChannelID {
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "Do I know you? I was not in your VC! You need to do /join first",
+		})
+		return
+	}
+
+	song, err := mc.FileFind(attachment.URL, attachment.Filename, int64(attachment.Size), i.Member.User.ID, i.ChannelID, v)
+	if err != nil {
+		log.Println("ERROR: File probe: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: mc.fileErrorMessage(err),
+		})
+		return
+	}
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: fmt.Sprintf("Let's dance to %q", song.data.Title),
+	})
+
+	go func() {
+		mc.songSignal <- song
+	}()
+}
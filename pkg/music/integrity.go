@@ -0,0 +1,294 @@
+package music
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+var errDownloadIncomplete = errors.New("download did not finish")
+
+// ytdlpDownload is the audio yt-dlp writes to stdout,
+// it keeps track of how much we got and how yt-dlp exited
+type ytdlpDownload struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+
+	mutex   sync.Mutex
+	n       int64
+	waited  bool
+	waitErr error
+}
+
+func downloadWithYTDLP(id string) (*ytdlpDownload, error) {
+	args := []string{
+		"-o", "-",
+		"-f bestaudio",
+		id,
+	}
+
+	yt := exec.Command("yt-dlp", args...)
+	data, err := yt.StdoutPipe()
+
+	yt.Stderr = os.Stderr
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Starts the yt command
+	err = yt.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ytdlpDownload{cmd: yt, stdout: data}, nil
+}
+
+func (d *ytdlpDownload) Read(p []byte) (int, error) {
+	n, err := d.stdout.Read(p)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.n += int64(n)
+	if err == io.EOF && !d.waited {
+		// all output is read, so we can find out how yt-dlp exited
+		d.waited = true
+		d.waitErr = d.cmd.Wait()
+	}
+
+	return n, err
+}
+
+// Close stops yt-dlp if it is still running
+func (d *ytdlpDownload) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.waited {
+		return nil
+	}
+
+	d.cmd.Process.Kill()
+	d.waited = true
+	d.waitErr = errDownloadIncomplete
+	d.cmd.Wait()
+	return nil
+}
+
+// Err returns nil if yt-dlp wrote all audio and exited without an error
+func (d *ytdlpDownload) Err() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch {
+	case !d.waited:
+		return errDownloadIncomplete
+	case d.waitErr != nil:
+		return fmt.Errorf("yt-dlp failed: %w", d.waitErr)
+	case d.n == 0:
+		return errors.New("yt-dlp did not download anything")
+	}
+	return nil
+}
+
+// Bytes returns how many bytes were downloaded so far
+func (d *ytdlpDownload) Bytes() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.n
+}
+
+// checkEncode returns an error if the song did not completely make it through yt-dlp and ffmpeg,
+// so we never cache a song that cuts off halfway
+func checkEncode(song Song, dw *ytdlpDownload, source dca.OpusReader) error {
+	err := dw.Err()
+	if err != nil {
+		return err
+	}
+
+	var encoded time.Duration
+	switch s := source.(type) {
+	case *dca.EncodeSession:
+		err = s.Error()
+		if err != nil {
+			return fmt.Errorf("ffmpeg failed: %w", err)
+		}
+		encoded = s.Stats().Duration
+	case *dca.Demuxer:
+		encoded = s.Duration()
+	}
+
+	expected := parseDuration(song.Duration)
+	if expected <= 0 {
+		// nothing to compare with
+		return nil
+	}
+
+	// the duration on a page is rounded and ffmpeg reports twice a second
+	margin := 5 * time.Second
+	if expected/50 > margin {
+		margin = expected / 50
+	}
+	if encoded < expected-margin || encoded > expected+margin {
+		return fmt.Errorf("encoded %s of a %s song (%d bytes downloaded)", encoded, expected, dw.Bytes())
+	}
+
+	return nil
+}
+
+// parseDuration is the reverse of formatDuration, it returns 0 for anything it does not understand
+func parseDuration(in string) time.Duration {
+	parts := strings.Split(in, ":")
+	if len(parts) > 4 {
+		return 0
+	}
+
+	var seconds int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0
+		}
+		if i == 1 && len(parts) == 4 {
+			// d:hh:mm:ss
+			seconds *= 24
+		} else {
+			seconds *= 60
+		}
+		seconds += n
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// hashReader checks the content hash of a cached song while it is read
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+
+	mutex    sync.Mutex
+	mismatch bool
+}
+
+// newHashReader returns a reader that verifies r against a hex SHA-256,
+// an empty expected hash is not checked
+func newHashReader(r io.Reader, expected string) *hashReader {
+	return &hashReader{
+		r:        r,
+		hash:     sha256.New(),
+		expected: expected,
+	}
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+
+	if err == io.EOF && h.expected != "" && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		h.mutex.Lock()
+		h.mismatch = true
+		h.mutex.Unlock()
+	}
+
+	return n, err
+}
+
+// Drain reads what nobody else did, like the frame index at the end of a version 2 file,
+// so the hash is checked
+func (h *hashReader) Drain() error {
+	_, err := io.Copy(ioutil.Discard, h)
+	return err
+}
+
+// Mismatch returns true if everything was read and the hash was not what we expected
+func (h *hashReader) Mismatch() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.mismatch
+}
+
+// VerifyCachedSong reads a whole song from the cache and returns an error if it is corrupt,
+// dca is decoded and checked against the hash in the index, anything else is checked with ffprobe
+func VerifyCachedSong(cache SongCache, index *CacheIndex, key string) error {
+	r, err := cache.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	entry, _ := index.Get(key)
+	verify := newHashReader(r, entry.SHA256)
+	br := bufio.NewReader(verify)
+
+	if magic, _ := br.Peek(3); string(magic) != "DCA" {
+		return probeCachedSong(br)
+	}
+
+	decoder := dca.NewDecoder(br)
+	err = decoder.ReadMetadata()
+	if err != nil {
+		return err
+	}
+
+	frames := 0
+	for {
+		_, err := decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", frames, err)
+		}
+		frames++
+	}
+	if frames == 0 {
+		return errors.New("no audio")
+	}
+	err = verify.Drain()
+	if err != nil {
+		return err
+	}
+	if verify.Mismatch() {
+		return errors.New("content hash does not match")
+	}
+
+	return nil
+}
+
+// probeCachedSong checks songs cached before we stored dca, ffprobe wants a file
+func probeCachedSong(r io.Reader) error {
+	tmp, err := ioutil.TempFile("", "disco-verify-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+
+	probe, err := dca.Probe(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if probe.Format.ParsedDuration() <= 0 {
+		return errors.New("no audio")
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package music
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+const (
+	// karaokeFilter cancels out what is in the middle of the stereo image, usually the vocals.
+	// Both channels get the same side signal, opposite channels would cancel out again in mono.
+	karaokeFilter = "pan=stereo|c0=0.5*c0-0.5*c1|c1=0.5*c0-0.5*c1"
+
+	lyricsTimeout = 10 * time.Second
+	// lyricsLead shows a line a bit early, singers need to read it first
+	lyricsLead = 500 * time.Millisecond
+	// lyricsEditInterval keeps us under the Discord rate limit for message edits
+	lyricsEditInterval = time.Second
+)
+
+// showLyrics posts the lyrics of the song and highlights the line being sung until stop is called
+func (v *VoiceInstance) showLyrics(song Song, stream *dca.StreamingSession) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lyricsTimeout)
+		lyrics, err := v.lyrics.Lyrics(ctx, song)
+		cancel()
+		if err == nil && len(lyrics.Synced) == 0 {
+			err = ErrNoLyrics
+		}
+		if errors.Is(err, ErrNoLyrics) {
+			v.session.ChannelMessageSend(song.ChannelID, fmt.Sprintf("I couldn't find synced lyrics for %s, you're on your own!", song.Title))
+			return
+		}
+		if err != nil {
+			log.Println("Could not get lyrics: ", err)
+			return
+		}
+
+		current := lyrics.Line(song.Start + stream.PlaybackPosition() + lyricsLead)
+		msg, err := v.session.ChannelMessageSendEmbed(song.ChannelID, karaokeEmbed(song, lyrics, current))
+		if err != nil {
+			log.Println("failed sending lyrics message: ", err)
+			return
+		}
+
+		ticker := time.NewTicker(lyricsEditInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			line := lyrics.Line(song.Start + stream.PlaybackPosition() + lyricsLead)
+			if line == current {
+				continue
+			}
+			current = line
+
+			_, err := v.session.ChannelMessageEditEmbed(msg.ChannelID, msg.ID, karaokeEmbed(song, lyrics, current))
+			if err != nil {
+				log.Println("failed updating lyrics message: ", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// karaokeEmbed shows the lines around current, with current highlighted
+func karaokeEmbed(song Song, lyrics *Lyrics, current int) *discordgo.MessageEmbed {
+	from := current - 1
+	if from < 0 {
+		from = 0
+	}
+	to := current + 4
+	if to > len(lyrics.Synced) {
+		to = len(lyrics.Synced)
+	}
+
+	lines := []string{}
+	for n := from; n < to; n++ {
+		text := lyrics.Synced[n].Text
+		if text == "" {
+			// instrumental part
+			text = "♪"
+		}
+		if n == current {
+			text = "🎤 **" + text + "**"
+		}
+		lines = append(lines, text)
+	}
+
+	return &discordgo.MessageEmbed{
+		Title:       "Karaoke: " + song.Title,
+		Description: strings.Join(lines, "\n"),
+	}
+}
+
+// Karaoke handles the /karaoke command
+func (mc *MusicCommand) Karaoke(i *discordgo.InteractionCreate) {
+	v := mc.CheckVC(i, true)
+	if v == nil {
+		return
+	}
+
+	v.karaoke = i.ApplicationCommandData().Options[0].BoolValue()
+
+	content := "Karaoke is over, the singers are back!"
+	if v.karaoke {
+		content = "Karaoke time! :microphone: From the next song on the vocals are gone and I'll show the lyrics as they are sung"
+	}
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+		},
+	})
+}
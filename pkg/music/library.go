@@ -0,0 +1,308 @@
+package music
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// maxLibraryResults is how many other matches we show after a /library search
+const maxLibraryResults = 5
+
+// LibraryTrack is a local audio file with the tags ffprobe found in it
+type LibraryTrack struct {
+	Path     string        `json:"path"` // relative to the library directory
+	Size     int64         `json:"size"`
+	ModTime  time.Time     `json:"modTime"`
+	Title    string        `json:"title"`
+	Artist   string        `json:"artist"`
+	Album    string        `json:"album"`
+	Genre    string        `json:"genre"`
+	Duration time.Duration `json:"duration"`
+
+	search string // lowercase text to search in
+}
+
+// Name returns how we show the track to users
+func (t LibraryTrack) Name() string {
+	title := t.Title
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+	}
+	if t.Artist != "" {
+		return fmt.Sprintf("%s - %s", t.Artist, title)
+	}
+	return title
+}
+
+// Library is a searchable index of a directory of audio files
+type Library struct {
+	dir       string
+	indexPath string
+
+	mutex  sync.RWMutex
+	tracks []LibraryTrack
+}
+
+// NewLibrary opens the library in dir, indexPath is where the index is kept between runs
+func NewLibrary(dir, indexPath string) (*Library, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Library{
+		dir:       dir,
+		indexPath: indexPath,
+	}
+
+	err = readJSONFile(indexPath, &l.tracks)
+	if err != nil {
+		return nil, fmt.Errorf("error reading library index: %w", err)
+	}
+	for i := range l.tracks {
+		l.tracks[i].search = searchText(l.tracks[i])
+	}
+
+	return l, nil
+}
+
+// Watch scans the library now and then every interval, it blocks forever
+func (l *Library) Watch(interval time.Duration) {
+	for {
+		err := l.Scan()
+		if err != nil {
+			log.Println("failed scanning library: ", err)
+		}
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Scan walks the library directory and probes all new or changed files
+func (l *Library) Scan() error {
+	l.mutex.RLock()
+	known := map[string]LibraryTrack{}
+	for _, t := range l.tracks {
+		known[t.Path] = t
+	}
+	l.mutex.RUnlock()
+
+	tracks := []LibraryTrack{}
+	probed := 0
+	err := filepath.Walk(l.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable directories should not stop the whole scan
+			log.Printf("library: skipping %s: %v", path, err)
+			return nil
+		}
+		if info.IsDir() || !audioFileExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return nil
+		}
+
+		if t, ok := known[rel]; ok && t.Size == info.Size() && t.ModTime.Equal(info.ModTime()) {
+			tracks = append(tracks, t)
+			return nil
+		}
+
+		probe, err := dca.Probe(path)
+		if err != nil {
+			log.Printf("library: could not probe %s: %v", path, err)
+			return nil
+		}
+		probed++
+
+		t := LibraryTrack{
+			Path:     rel,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Title:    probe.Format.Tags.Title,
+			Artist:   probe.Format.Tags.Artist,
+			Album:    probe.Format.Tags.Album,
+			Genre:    probe.Format.Tags.Genre,
+			Duration: probe.Format.ParsedDuration(),
+		}
+		t.search = searchText(t)
+		tracks = append(tracks, t)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.tracks = tracks
+	l.mutex.Unlock()
+
+	log.Printf("Library has %d tracks, %d newly indexed", len(tracks), probed)
+
+	return writeJSONFile(l.indexPath, tracks)
+}
+
+// Search returns the tracks that match all words in the query, best matches first
+func (l *Library) Search(query string) []LibraryTrack {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil
+	}
+
+	type match struct {
+		track LibraryTrack
+		score int
+	}
+	matches := []match{}
+
+	l.mutex.RLock()
+	for _, t := range l.tracks {
+		score := 0
+		for _, w := range words {
+			if !strings.Contains(t.search, w) {
+				score = -1
+				break
+			}
+			// words found in the title count more than ones in the album or path
+			if strings.Contains(strings.ToLower(t.Title), w) {
+				score += 2
+			}
+			if strings.Contains(strings.ToLower(t.Artist), w) {
+				score++
+			}
+		}
+		if score >= 0 {
+			matches = append(matches, match{t, score})
+		}
+	}
+	l.mutex.RUnlock()
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	out := make([]LibraryTrack, len(matches))
+	for i, m := range matches {
+		out[i] = m.track
+	}
+	return out
+}
+
+// Size returns the number of indexed tracks
+func (l *Library) Size() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.tracks)
+}
+
+// AbsPath returns the path of a track on disk
+func (l *Library) AbsPath(t LibraryTrack) string {
+	return filepath.Join(l.dir, t.Path)
+}
+
+func searchText(t LibraryTrack) string {
+	return strings.ToLower(strings.Join([]string{t.Title, t.Artist, t.Album, t.Genre, t.Path}, " "))
+}
+
+// LibraryFind searches the local library and turns the best match into a song
+func (m *MusicCommand) LibraryFind(query, uID, chID string, v *VoiceInstance) (song_struct PkgSong, others []LibraryTrack, err error) {
+	results := m.library.Search(query)
+	if len(results) == 0 {
+		err = fmt.Errorf("no track matching %q", query)
+		return
+	}
+
+	t := results[0]
+	others = results[1:]
+
+	song_struct.data = Song{
+		ChannelID: chID,
+		User:      uID,
+		ID:        uID,
+		VidID:     t.Path,
+		Title:     t.Name(),
+		Duration:  formatDuration(int(t.Duration.Seconds())),
+		Source:    SourceLibrary,
+		URL:       m.library.AbsPath(t),
+	}
+	song_struct.v = v
+
+	return
+}
+
+// Library handles /library, it plays the best match from the local library
+func (mc *MusicCommand) Library(i *discordgo.InteractionCreate) {
+	if mc.library == nil {
+		mc.respondHidden(i, "I don't have a record collection here, sorry")
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	v := mc.CheckVC(i, false)
+	if v == nil {
+		err := mc.Join(i, true)
+		if err != nil {
+			mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+				Content: err.Error(),
+			})
+		}
+		v = mc.CheckVC(i, true)
+		if v == nil { // try twice
+			return
+		}
+	}
+
+	// if the user is not a voice channel not accept the command
+	voiceChannelID := mc.SearchVoiceChannel(i.Member.User.ID)
+	if v.voice.ChannelID != voiceChannelID {
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "Do I know you? I was not in your VC! You need to do /join first",
+		})
+		return
+	}
+
+	query := i.ApplicationCommandData().Options[0].StringValue()
+	song, others, err := mc.LibraryFind(query, i.Member.User.ID, i.ChannelID, v)
+	if err != nil {
+		log.Println("ERROR: Library search: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: fmt.Sprintf("I went through all %d records, but none of them match that", mc.library.Size()),
+		})
+		return
+	}
+
+	content := fmt.Sprintf("Dropping the needle on %q", song.data.Title)
+	if len(others) > 0 {
+		if len(others) > maxLibraryResults {
+			others = others[:maxLibraryResults]
+		}
+		names := []string{}
+		for _, t := range others {
+			names = append(names, t.Name())
+		}
+		content += fmt.Sprintf("\nNot the one? I also found:\n%s", strings.Join(names, "\n"))
+	}
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: content,
+	})
+
+	go func() {
+		mc.songSignal <- song
+	}()
+}
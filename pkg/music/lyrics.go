@@ -0,0 +1,395 @@
+package music
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrNoLyrics is returned by a LyricsProvider that has nothing for a song
+var ErrNoLyrics = errors.New("no lyrics found")
+
+// LyricLine is a line of synced lyrics and when it is sung
+type LyricLine struct {
+	Time time.Duration `json:"time"`
+	Text string        `json:"text"`
+}
+
+// Lyrics are the words of a song, Synced is empty if we don't know the timing
+type Lyrics struct {
+	Plain  string      `json:"plain"`
+	Synced []LyricLine `json:"synced,omitempty"`
+}
+
+// Line returns the index of the line sung at position, -1 before the first line
+func (l *Lyrics) Line(position time.Duration) int {
+	return sort.Search(len(l.Synced), func(i int) bool {
+		return l.Synced[i].Time > position
+	}) - 1
+}
+
+// LyricsProvider finds the lyrics of a song
+type LyricsProvider interface {
+	Lyrics(ctx context.Context, song Song) (*Lyrics, error)
+}
+
+// Text returns the plain lyrics, made from the synced ones if we only have those
+func (l *Lyrics) Text() string {
+	if l.Plain != "" || len(l.Synced) == 0 {
+		return l.Plain
+	}
+	lines := []string{}
+	for _, line := range l.Synced {
+		lines = append(lines, line.Text)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// LyricsProviders asks every provider in order until one has the lyrics
+type LyricsProviders []LyricsProvider
+
+func (l LyricsProviders) Lyrics(ctx context.Context, song Song) (*Lyrics, error) {
+	for _, provider := range l {
+		lyrics, err := provider.Lyrics(ctx, song)
+		if err == nil {
+			return lyrics, nil
+		}
+		if !errors.Is(err, ErrNoLyrics) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoLyrics
+}
+
+// LRCFiles finds lyrics in a .lrc file next to a library track
+type LRCFiles struct{}
+
+func (LRCFiles) Lyrics(ctx context.Context, song Song) (*Lyrics, error) {
+	if song.Source != SourceLibrary {
+		return nil, ErrNoLyrics
+	}
+
+	f, err := os.Open(strings.TrimSuffix(song.URL, filepath.Ext(song.URL)) + ".lrc")
+	if os.IsNotExist(err) {
+		return nil, ErrNoLyrics
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseLRC(f)
+}
+
+// titleJunk matches what YouTube uploaders put in titles that is not part of the song name
+var titleJunk = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\s*[(\[][^)\]]*\b(official|video|audio|lyrics?|visuali[sz]er|hd|hq|4k|remaster(ed)?|explicit|live|feat\.?|ft\.?|prod\.?)\b[^)\]]*[)\]]`),
+	regexp.MustCompile(`(?i)\s*-?\s*\bofficial\s+(music\s+|lyric\s+)?video\s*$`),
+	regexp.MustCompile(`\s+(\||//)\s.*$`),
+}
+
+// cleanTitle takes the junk out of a song title so a lyrics search can find it
+func cleanTitle(title string) string {
+	for _, junk := range titleJunk {
+		title = junk.ReplaceAllString(title, "")
+	}
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// LRCLib asks an LRCLIB compatible API, like https://lrclib.net
+type LRCLib string
+
+// lrclibResult is a search result of the LRCLIB API
+type lrclibResult struct {
+	PlainLyrics  string `json:"plainLyrics"`
+	SyncedLyrics string `json:"syncedLyrics"`
+}
+
+func (l LRCLib) Lyrics(ctx context.Context, song Song) (*Lyrics, error) {
+	link := strings.TrimSuffix(string(l), "/") + "/api/search?q=" + url.QueryEscape(cleanTitle(song.Title))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	// LRCLIB asks clients to say who they are
+	req.Header.Set("User-Agent", "disco (https://github.com/meyskens/thomas-disco)")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lyrics API returned %s", resp.Status)
+	}
+
+	results := []lrclibResult{}
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	// synced lyrics go first, the search puts the best match first otherwise
+	var plain *lrclibResult
+	for n, result := range results {
+		if result.SyncedLyrics != "" {
+			lyrics, err := ParseLRC(strings.NewReader(result.SyncedLyrics))
+			if err == nil {
+				return lyrics, nil
+			}
+		}
+		if plain == nil && result.PlainLyrics != "" {
+			plain = &results[n]
+		}
+	}
+	if plain != nil {
+		return &Lyrics{Plain: plain.PlainLyrics}, nil
+	}
+
+	return nil, ErrNoLyrics
+}
+
+// lrcTag matches the [mm:ss.xx] time tags at the start of an LRC line
+var lrcTag = regexp.MustCompile(`^\[(\d+):(\d+(?:[.:]\d+)?)\]`)
+
+// lrcOffset matches the [offset:ms] tag, positive offsets make the lines come sooner
+var lrcOffset = regexp.MustCompile(`^\[offset:\s*([+-]?\d+)\]`)
+
+// ParseLRC reads LRC lyrics, a line can have more than one time tag if it is sung more than once
+func ParseLRC(r io.Reader) (*Lyrics, error) {
+	lyrics := &Lyrics{}
+	plain := []string{}
+	offset := time.Duration(0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := lrcOffset.FindStringSubmatch(line); m != nil {
+			ms, _ := strconv.Atoi(m[1])
+			offset = time.Duration(ms) * time.Millisecond
+			continue
+		}
+
+		times := []time.Duration{}
+		for {
+			m := lrcTag.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			minutes, _ := strconv.Atoi(m[1])
+			seconds, _ := strconv.ParseFloat(strings.Replace(m[2], ":", ".", 1), 64)
+			times = append(times, time.Duration(minutes)*time.Minute+time.Duration(seconds*float64(time.Second)))
+			line = strings.TrimSpace(line[len(m[0]):])
+		}
+		if len(times) == 0 {
+			// [ar:artist] and friends
+			continue
+		}
+
+		plain = append(plain, line)
+		for _, t := range times {
+			lyrics.Synced = append(lyrics.Synced, LyricLine{Time: t, Text: line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lyrics.Synced) == 0 {
+		return nil, ErrNoLyrics
+	}
+
+	sort.SliceStable(lyrics.Synced, func(i, j int) bool {
+		return lyrics.Synced[i].Time < lyrics.Synced[j].Time
+	})
+	for n := range lyrics.Synced {
+		lyrics.Synced[n].Time -= offset
+	}
+	lyrics.Plain = strings.TrimSpace(strings.Join(plain, "\n"))
+
+	return lyrics, nil
+}
+
+// maxCachedLyrics is how many songs LyricsCache remembers, the oldest go first
+const maxCachedLyrics = 1000
+
+// cachedLyrics are lyrics a provider found before
+type cachedLyrics struct {
+	Lyrics  *Lyrics   `json:"lyrics"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// LyricsCache remembers what a LyricsProvider found in a JSON file, by cleaned up title
+type LyricsCache struct {
+	provider LyricsProvider
+
+	mutex  sync.Mutex
+	path   string
+	lyrics map[string]*cachedLyrics
+}
+
+// NewLyricsCache remembers the lyrics provider finds in path
+func NewLyricsCache(provider LyricsProvider, path string) (*LyricsCache, error) {
+	c := &LyricsCache{
+		provider: provider,
+		path:     path,
+		lyrics:   map[string]*cachedLyrics{},
+	}
+
+	err := readJSONFile(path, &c.lyrics)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lyrics cache: %w", err)
+	}
+
+	return c, nil
+}
+
+func (c *LyricsCache) Lyrics(ctx context.Context, song Song) (*Lyrics, error) {
+	key := normalizeQuery(cleanTitle(song.Title))
+
+	c.mutex.Lock()
+	cached, ok := c.lyrics[key]
+	c.mutex.Unlock()
+	if ok {
+		return cached.Lyrics, nil
+	}
+
+	lyrics, err := c.provider.Lyrics(ctx, song)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lyrics[key] = &cachedLyrics{Lyrics: lyrics, Fetched: time.Now()}
+	for len(c.lyrics) > maxCachedLyrics {
+		oldest := ""
+		for k, l := range c.lyrics {
+			if oldest == "" || l.Fetched.Before(c.lyrics[oldest].Fetched) {
+				oldest = k
+			}
+		}
+		delete(c.lyrics, oldest)
+	}
+
+	err = writeJSONFile(c.path, c.lyrics)
+	if err != nil {
+		log.Println("failed saving lyrics cache: ", err)
+	}
+
+	return lyrics, nil
+}
+
+// lyricsEmbedLength is how much text fits in the description of an embed
+const lyricsEmbedLength = 4096
+
+// lyricsEmbeds splits lyrics over as many embeds as they need, on line ends where possible
+func lyricsEmbeds(title, text string) []*discordgo.MessageEmbed {
+	parts := []string{}
+	part := ""
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > lyricsEmbedLength {
+			// a line that fits nowhere, cut it between runes
+			cut := lyricsEmbedLength
+			for !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if part != "" {
+				parts = append(parts, part)
+				part = ""
+			}
+			parts = append(parts, line[:cut])
+			line = line[cut:]
+		}
+
+		if part != "" && len(part)+1+len(line) > lyricsEmbedLength {
+			parts = append(parts, part)
+			part = ""
+		}
+		if part != "" {
+			part += "\n"
+		}
+		part += line
+	}
+	if part != "" {
+		parts = append(parts, part)
+	}
+
+	embeds := []*discordgo.MessageEmbed{}
+	for n, p := range parts {
+		embed := &discordgo.MessageEmbed{
+			Description: p,
+		}
+		if n == 0 {
+			embed.Title = title
+		}
+		embeds = append(embeds, embed)
+	}
+	return embeds
+}
+
+// Lyrics handles the /lyrics command
+func (mc *MusicCommand) Lyrics(i *discordgo.InteractionCreate) {
+	song := Song{}
+	if options := i.ApplicationCommandData().Options; len(options) > 0 {
+		song.Title = options[0].StringValue()
+	} else if v := mc.voiceInstance(i.GuildID); v != nil && v.speaking {
+		song = v.nowPlaying
+	}
+	if strings.TrimSpace(song.Title) == "" {
+		mc.respondHidden(i, "Nothing is playing, tell me which song you want the lyrics of")
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), lyricsTimeout)
+	defer cancel()
+	lyrics, err := mc.lyrics.Lyrics(ctx, song)
+	if err == nil && lyrics.Text() == "" {
+		err = ErrNoLyrics
+	}
+	if err != nil {
+		if !errors.Is(err, ErrNoLyrics) {
+			log.Println("ERROR: getting lyrics: ", err)
+		}
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: fmt.Sprintf("I couldn't find the lyrics of %s :(", cleanTitle(song.Title)),
+		})
+		return
+	}
+
+	// embeds in one message can only have 6000 characters together, so every part gets its own
+	embeds := lyricsEmbeds(cleanTitle(song.Title), lyrics.Text())
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Embeds: embeds[:1],
+	})
+	for _, embed := range embeds[1:] {
+		_, err := mc.dg.FollowupMessageCreate(mc.dg.State.User.ID, i.Interaction, false, &discordgo.WebhookParams{
+			Embeds: []*discordgo.MessageEmbed{embed},
+		})
+		if err != nil {
+			log.Println("ERROR: sending lyrics: ", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package music
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLRC(t *testing.T) {
+	lyrics, err := ParseLRC(strings.NewReader(`[ar:Rick Astley]
+[ti:Never Gonna Give You Up]
+[offset:+500]
+[00:18.50]We're no strangers to love
+[00:22.00][01:10.25]You know the rules
+[00:26]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []LyricLine{
+		{18 * time.Second, "We're no strangers to love"},
+		{21500 * time.Millisecond, "You know the rules"},
+		{25500 * time.Millisecond, ""},
+		{69750 * time.Millisecond, "You know the rules"},
+	}
+	if len(lyrics.Synced) != len(want) {
+		t.Fatalf("expected %d lines, got %v", len(want), lyrics.Synced)
+	}
+	for n, line := range want {
+		if lyrics.Synced[n] != line {
+			t.Errorf("line %d: expected %v, got %v", n, line, lyrics.Synced[n])
+		}
+	}
+
+	for position, line := range map[time.Duration]int{
+		0:                -1,
+		18 * time.Second: 0,
+		time.Minute:      2,
+		time.Hour:        3,
+	} {
+		if got := lyrics.Line(position); got != line {
+			t.Errorf("line at %s: expected %d, got %d", position, line, got)
+		}
+	}
+
+	if _, err := ParseLRC(strings.NewReader("just words\n")); err != ErrNoLyrics {
+		t.Errorf("expected ErrNoLyrics, got %v", err)
+	}
+}
+
+func TestCleanTitle(t *testing.T) {
+	for title, want := range map[string]string{
+		"Rick Astley - Never Gonna Give You Up (Official Music Video)": "Rick Astley - Never Gonna Give You Up",
+		"Daft Punk - One More Time [Official Video] | Daft Punk":       "Daft Punk - One More Time",
+		"AC/DC - Thunderstruck (Live At River Plate, December 2009)":   "AC/DC - Thunderstruck",
+		"Queen – Bohemian Rhapsody (Remastered 2011)":                  "Queen – Bohemian Rhapsody",
+		"Eminem - Stan (Long Version) ft. Dido":                        "Eminem - Stan (Long Version) ft. Dido",
+	} {
+		if got := cleanTitle(title); got != want {
+			t.Errorf("cleanTitle(%q): expected %q, got %q", title, want, got)
+		}
+	}
+}
+
+func TestLyricsEmbeds(t *testing.T) {
+	line := strings.Repeat("la", 50)
+	text := strings.TrimSuffix(strings.Repeat(line+"\n", 100), "\n")
+
+	embeds := lyricsEmbeds("Song", text)
+	if len(embeds) != 3 {
+		t.Fatalf("expected 3 embeds, got %d", len(embeds))
+	}
+	if embeds[0].Title != "Song" || embeds[1].Title != "" {
+		t.Error("expected only the first embed to have a title")
+	}
+
+	joined := []string{}
+	for _, embed := range embeds {
+		if len(embed.Description) > lyricsEmbedLength {
+			t.Errorf("embed of %d characters is too long", len(embed.Description))
+		}
+		if strings.HasPrefix(embed.Description, "\n") || !strings.HasSuffix(embed.Description, line) {
+			t.Error("expected embeds to be split between lines")
+		}
+		joined = append(joined, embed.Description)
+	}
+	if strings.Join(joined, "\n") != text {
+		t.Error("expected the embeds to have all lyrics")
+	}
+
+	if embeds := lyricsEmbeds("Long", strings.Repeat("é", lyricsEmbedLength)); len(embeds) != 2 {
+		t.Errorf("expected a line that is too long to be cut in 2, got %d embeds", len(embeds))
+	}
+}
@@ -0,0 +1,91 @@
+package music
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// sendNowPlaying posts what is playing to the channel the song was requested in
+func (v *VoiceInstance) sendNowPlaying() {
+	v.nowPlayingMutex.Lock()
+	defer v.nowPlayingMutex.Unlock()
+
+	v.nowPlayingMessage = nil
+	v.onAir = ""
+
+	song := v.nowPlaying
+	if v.session == nil || song.ChannelID == "" {
+		return
+	}
+
+	msg, err := v.session.ChannelMessageSendEmbed(song.ChannelID, v.nowPlayingEmbed())
+	if err != nil {
+		log.Println("failed sending now playing message: ", err)
+		return
+	}
+	v.nowPlayingMessage = msg
+}
+
+// updateNowPlaying changes what is on air in the now playing message of a live stream
+func (v *VoiceInstance) updateNowPlaying(onAir string) {
+	v.nowPlayingMutex.Lock()
+	defer v.nowPlayingMutex.Unlock()
+
+	if v.onAir == onAir {
+		return
+	}
+	v.onAir = onAir
+
+	if v.nowPlayingMessage == nil {
+		return
+	}
+
+	_, err := v.session.ChannelMessageEditEmbed(v.nowPlayingMessage.ChannelID, v.nowPlayingMessage.ID, v.nowPlayingEmbed())
+	if err != nil {
+		log.Println("failed updating now playing message: ", err)
+	}
+}
+
+// nowPlayingEmbed builds the now playing message, the caller holds nowPlayingMutex
+func (v *VoiceInstance) nowPlayingEmbed() *discordgo.MessageEmbed {
+	song := v.nowPlaying
+
+	embed := &discordgo.MessageEmbed{
+		Title:       song.Title,
+		URL:         song.URL,
+		Description: fmt.Sprintf("Now dancing to this one, requested by <@%s>", song.User),
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:   "Duration",
+				Value:  song.Duration,
+				Inline: true,
+			},
+		},
+	}
+	if song.Autoplay {
+		embed.Description = "Now dancing to this one, picked by autoplay"
+	}
+	if song.Source == SourceLive {
+		embed.Fields[0].Value = "🔴 LIVE"
+		if v.onAir != "" {
+			embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+				Name:  "On air",
+				Value: v.onAir,
+			})
+		}
+	}
+	if song.Extractor != "" {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   "Source",
+			Value:  song.Extractor,
+			Inline: true,
+		})
+	}
+	if song.Thumbnail != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: song.Thumbnail}
+	}
+
+	return embed
+}
@@ -0,0 +1,403 @@
+package music
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxPodcastEpisodes is the number of episodes we show, Discord allows 25 options in a select menu
+	maxPodcastEpisodes = 25
+	// podcastMenuTimeout is how long a select menu is valid, same as the interaction token
+	podcastMenuTimeout = 15 * time.Minute
+	// podcastResumeMargin is how close to the start or end we do not bother to resume
+	podcastResumeMargin = 30 * time.Second
+	// podcastFeedTimeout is how long a feed may take to download, the interaction waits for it
+	podcastFeedTimeout = 30 * time.Second
+)
+
+// podcastClient downloads feeds, a server that does not answer should not hold up /podcast
+var podcastClient = &http.Client{Timeout: podcastFeedTimeout}
+
+// Episode is a single episode of a podcast feed
+type Episode struct {
+	Title     string
+	GUID      string
+	URL       string
+	Published time.Time
+	Duration  time.Duration
+}
+
+type rssFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Image struct {
+			URL string `xml:"url"`
+		} `xml:"image"`
+		Items []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			PubDate   string `xml:"pubDate"`
+			Duration  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+			Enclosure struct {
+				URL  string `xml:"url,attr"`
+				Type string `xml:"type,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atomFeed struct {
+	Title   string `xml:"title"`
+	Icon    string `xml:"icon"`
+	Entries []struct {
+		Title   string `xml:"title"`
+		ID      string `xml:"id"`
+		Updated string `xml:"updated"`
+		Links   []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// Podcast is a parsed RSS or Atom podcast feed
+type Podcast struct {
+	Title    string
+	Image    string
+	Episodes []Episode
+}
+
+// FetchPodcast downloads and parses a RSS or Atom feed, newest episodes first
+func FetchPodcast(ctx context.Context, link string) (*Podcast, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := podcastClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned %s", resp.Status)
+	}
+
+	var root struct {
+		XMLName xml.Name
+		rssFeed
+		atomFeed
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing feed: %w", err)
+	}
+
+	podcast := &Podcast{}
+	switch root.XMLName.Local {
+	case "rss":
+		podcast.Title = root.rssFeed.Channel.Title
+		podcast.Image = root.rssFeed.Channel.Image.URL
+		for _, item := range root.rssFeed.Channel.Items {
+			if item.Enclosure.URL == "" {
+				continue
+			}
+			guid := item.GUID
+			if guid == "" {
+				guid = item.Enclosure.URL
+			}
+			published, _ := time.Parse(time.RFC1123Z, item.PubDate)
+			if published.IsZero() {
+				published, _ = time.Parse(time.RFC1123, item.PubDate)
+			}
+			podcast.Episodes = append(podcast.Episodes, Episode{
+				Title:     item.Title,
+				GUID:      guid,
+				URL:       item.Enclosure.URL,
+				Published: published,
+				Duration:  parseItunesDuration(item.Duration),
+			})
+		}
+	case "feed":
+		podcast.Title = root.atomFeed.Title
+		podcast.Image = root.atomFeed.Icon
+		for _, entry := range root.atomFeed.Entries {
+			for _, l := range entry.Links {
+				if l.Rel != "enclosure" || l.Href == "" {
+					continue
+				}
+				guid := entry.ID
+				if guid == "" {
+					guid = l.Href
+				}
+				published, _ := time.Parse(time.RFC3339, entry.Updated)
+				podcast.Episodes = append(podcast.Episodes, Episode{
+					Title:     entry.Title,
+					GUID:      guid,
+					URL:       l.Href,
+					Published: published,
+				})
+				break
+			}
+		}
+	default:
+		return nil, errors.New("not a RSS or Atom feed")
+	}
+
+	sort.SliceStable(podcast.Episodes, func(i, j int) bool {
+		return podcast.Episodes[i].Published.After(podcast.Episodes[j].Published)
+	})
+
+	return podcast, nil
+}
+
+// parseItunesDuration parses the HH:MM:SS, MM:SS or seconds format of itunes:duration
+func parseItunesDuration(in string) time.Duration {
+	var seconds int
+	for _, part := range strings.Split(strings.TrimSpace(in), ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// podcastMenu is a select menu waiting for the user to pick an episode
+type podcastMenu struct {
+	podcast *Podcast
+	created time.Time
+}
+
+// positionStore remembers where every user stopped listening to an episode
+type positionStore struct {
+	mutex     sync.Mutex
+	path      string
+	positions map[string]map[string]time.Duration // user -> episode GUID -> position
+}
+
+func newPositionStore(path string) (*positionStore, error) {
+	p := &positionStore{
+		path:      path,
+		positions: map[string]map[string]time.Duration{},
+	}
+
+	err := readJSONFile(path, &p.positions)
+	if err != nil {
+		return nil, fmt.Errorf("error reading podcast positions: %w", err)
+	}
+
+	return p, nil
+}
+
+// Get returns where the user left an episode, 0 to start from the beginning
+func (p *positionStore) Get(user, guid string) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.positions[user][guid]
+}
+
+// Remember saves where the requester of the song stopped listening,
+// an episode that was played until the end is forgotten
+func (p *positionStore) Remember(song Song, position time.Duration, stopped bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.positions[song.User] == nil {
+		p.positions[song.User] = map[string]time.Duration{}
+	}
+
+	if stopped && position > podcastResumeMargin {
+		p.positions[song.User][song.VidID] = position
+	} else {
+		delete(p.positions[song.User], song.VidID)
+	}
+
+	err := writeJSONFile(p.path, p.positions)
+	if err != nil {
+		log.Println("failed saving podcast positions: ", err)
+	}
+}
+
+// Podcast handles /podcast, it shows a menu to pick an episode from the feed
+func (mc *MusicCommand) Podcast(i *discordgo.InteractionCreate) {
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: 64, // hidden
+		},
+	})
+
+	link := i.ApplicationCommandData().Options[0].StringValue()
+	ctx, cancel := context.WithTimeout(context.Background(), podcastFeedTimeout)
+	defer cancel()
+	podcast, err := FetchPodcast(ctx, link)
+	if err != nil || len(podcast.Episodes) == 0 {
+		log.Println("ERROR: Podcast: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "I couldn't find any episodes in that feed",
+		})
+		return
+	}
+
+	episodes := podcast.Episodes
+	if len(episodes) > maxPodcastEpisodes {
+		episodes = episodes[:maxPodcastEpisodes]
+	}
+
+	options := []discordgo.SelectMenuOption{}
+	for n, episode := range episodes {
+		description := episode.Published.Format("2006-01-02")
+		if episode.Duration > 0 {
+			description += " - " + formatDuration(int(episode.Duration.Seconds()))
+		}
+		if pos := mc.positions.Get(i.Member.User.ID, episode.GUID); pos > 0 {
+			description += fmt.Sprintf(" - resume at %s", formatDuration(int(pos.Seconds())))
+		}
+		options = append(options, discordgo.SelectMenuOption{
+			Label:       truncate(episode.Title, 100),
+			Value:       strconv.Itoa(n),
+			Description: description,
+		})
+	}
+
+	mc.podcastMutex.Lock()
+	for id, menu := range mc.podcastMenus {
+		if time.Since(menu.created) > podcastMenuTimeout {
+			delete(mc.podcastMenus, id)
+		}
+	}
+	mc.podcastMenus[i.ID] = &podcastMenu{
+		podcast: podcast,
+		created: time.Now(),
+	}
+	mc.podcastMutex.Unlock()
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: fmt.Sprintf("Which episode of **%s** do you want to hear?", podcast.Title),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.SelectMenu{
+						CustomID:    "podcast:" + i.ID,
+						Placeholder: "Pick an episode",
+						Options:     options,
+					},
+				},
+			},
+		},
+	})
+}
+
+// PodcastEpisode handles the pick from the /podcast select menu
+func (mc *MusicCommand) PodcastEpisode(i *discordgo.InteractionCreate) {
+	data := i.MessageComponentData()
+	id := strings.TrimPrefix(data.CustomID, "podcast:")
+
+	mc.podcastMutex.Lock()
+	menu, ok := mc.podcastMenus[id]
+	mc.podcastMutex.Unlock()
+
+	n := -1
+	if len(data.Values) == 1 {
+		n, _ = strconv.Atoi(data.Values[0])
+	}
+	if !ok || n < 0 || n >= len(menu.podcast.Episodes) {
+		mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    "This menu has expired, run /podcast again",
+				Components: []discordgo.MessageComponent{},
+			},
+		})
+		return
+	}
+	episode := menu.podcast.Episodes[n]
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    fmt.Sprintf("Queueing %q", episode.Title),
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+
+	v := mc.CheckVC(i, false)
+	if v == nil {
+		err := mc.Join(i, true)
+		if err != nil {
+			return
+		}
+		v = mc.CheckVC(i, false)
+		if v == nil {
+			return
+		}
+	}
+
+	// if the user is not a voice channel not accept the command
+	voiceChannelID := mc.SearchVoiceChannel(i.Member.User.ID)
+	if v.voice.ChannelID != voiceChannelID {
+		mc.dg.ChannelMessageSend(i.ChannelID, "Do I know you? I was not in your VC! You need to do /join first")
+		return
+	}
+
+	start := mc.positions.Get(i.Member.User.ID, episode.GUID)
+	if episode.Duration > 0 && start > episode.Duration-podcastResumeMargin {
+		start = 0
+	}
+
+	duration := "?"
+	if episode.Duration > 0 {
+		duration = formatDuration(int(episode.Duration.Seconds()))
+	}
+
+	song := PkgSong{
+		data: Song{
+			ChannelID: i.ChannelID,
+			User:      i.Member.User.ID,
+			ID:        i.Member.User.ID,
+			VidID:     episode.GUID,
+			Title:     fmt.Sprintf("%s: %s", menu.podcast.Title, episode.Title),
+			Duration:  duration,
+			Source:    SourcePodcast,
+			URL:       episode.URL,
+			Thumbnail: menu.podcast.Image,
+			Start:     start,
+		},
+		v: v,
+	}
+
+	content := fmt.Sprintf("<@%s> put on %q", i.Member.User.ID, episode.Title)
+	if start > 0 {
+		content += fmt.Sprintf(", picking up where you left at %s", formatDuration(int(start.Seconds())))
+	}
+	mc.dg.ChannelMessageSend(i.ChannelID, content)
+
+	go func() {
+		mc.songSignal <- song
+	}()
+}
+
+// truncate cuts a string to at most n runes
+func truncate(in string, n int) string {
+	r := []rune(in)
+	if len(r) <= n {
+		return in
+	}
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,54 @@
+package music
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// PlaylistLinks lists the links to the songs in a playlist yt-dlp can read
+func PlaylistLinks(link string) ([]string, error) {
+	entries, err := ytdlpFlatPlaylist(link, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	links := []string{}
+	for _, entry := range entries {
+		if entry.URL != "" {
+			links = append(links, entry.URL)
+		}
+	}
+
+	return links, nil
+}
+
+// FindSong looks up a link with yt-dlp, like playing it would
+func FindSong(link string) (Song, error) {
+	info, err := ytdlpDumpJSON(link)
+	if err != nil {
+		return Song{}, err
+	}
+	if info.IsLive {
+		return Song{}, errors.New("live streams are not supported")
+	}
+	if info.ID == "" || info.Extractor == "" {
+		return Song{}, errors.New("no song found")
+	}
+
+	return info.song(link), nil
+}
+
+// StoreSong downloads and encodes a song into the cache without playing it
+func StoreSong(cache SongCache, index *CacheIndex, song Song) error {
+	d := newDownloads(cache, index)
+	// nobody listened to it yet
+	d.unplayed = true
+
+	r := d.Open(song)
+	// the song is stored while we read it
+	io.Copy(ioutil.Discard, r)
+	r.Close()
+
+	return r.Stored()
+}
@@ -0,0 +1,474 @@
+package music
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+// maxLiveReconnects is how many times in a row we try to get a dropped stream back
+const maxLiveReconnects = 5
+
+var errNoStation = errors.New("no such station")
+
+// RadioFind resolves a preset name or stream link into a live song
+func (m *MusicCommand) RadioFind(station, guildID, uID, chID string, v *VoiceInstance) (song_struct PkgSong, err error) {
+	name := station
+	link, ok := m.radioPreset(guildID, station)
+	if !ok {
+		u, err := url.Parse(station)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return song_struct, errNoStation
+		}
+		link = station
+		name = u.Hostname()
+	}
+
+	link, err = resolveStreamPlaylist(link)
+	if err != nil {
+		return
+	}
+
+	song_struct.data = Song{
+		ChannelID: chID,
+		User:      uID,
+		ID:        uID,
+		VidID:     link,
+		Title:     name,
+		Duration:  "LIVE",
+		Source:    SourceLive,
+		URL:       link,
+	}
+	song_struct.v = v
+
+	return
+}
+
+// radioPreset looks up a station name, guild presets go before the global ones
+func (m *MusicCommand) radioPreset(guildID, name string) (string, bool) {
+	name = strings.ToLower(name)
+	if link, ok := m.settings.Get(guildID).RadioPresets[name]; ok {
+		return link, true
+	}
+	// the presets from the command line can have any case
+	for n, link := range m.opts.RadioPresets {
+		if strings.ToLower(n) == name {
+			return link, true
+		}
+	}
+	return "", false
+}
+
+// resolveStreamPlaylist follows .pls and .m3u playlists to the first stream in them
+func resolveStreamPlaylist(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if ext != ".pls" && ext != ".m3u" {
+		return link, nil
+	}
+
+	resp, err := fileClient.Get(link)
+	if err != nil {
+		return "", fmt.Errorf("error getting playlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if ext == ".pls" {
+			// File1=http://...
+			if !strings.HasPrefix(strings.ToLower(line), "file") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			line = strings.TrimSpace(parts[1])
+		}
+		if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+			return line, nil
+		}
+	}
+
+	return "", errors.New("no stream found in playlist")
+}
+
+// isHLS returns true if the link is a HTTP Live Streaming playlist
+func isHLS(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return strings.ToLower(path.Ext(u.Path)) == ".m3u8"
+}
+
+// icyReader strips the ICY metadata blocks out of a Shoutcast/Icecast stream
+type icyReader struct {
+	r        io.ReadCloser
+	metaInt  int
+	left     int
+	onTitle  func(title string)
+	curTitle string
+}
+
+func (i *icyReader) Read(p []byte) (int, error) {
+	if i.left == 0 {
+		err := i.readMetadata()
+		if err != nil {
+			return 0, err
+		}
+		i.left = i.metaInt
+	}
+
+	if len(p) > i.left {
+		p = p[:i.left]
+	}
+	n, err := i.r.Read(p)
+	i.left -= n
+	return n, err
+}
+
+func (i *icyReader) readMetadata() error {
+	var size [1]byte
+	_, err := io.ReadFull(i.r, size[:])
+	if err != nil {
+		return err
+	}
+	if size[0] == 0 {
+		return nil
+	}
+
+	meta := make([]byte, int(size[0])*16)
+	_, err = io.ReadFull(i.r, meta)
+	if err != nil {
+		return err
+	}
+
+	// StreamTitle='Artist - Title';StreamUrl='';
+	for _, field := range strings.Split(strings.TrimRight(string(meta), "\x00"), ";") {
+		if !strings.HasPrefix(field, "StreamTitle=") {
+			continue
+		}
+		title := strings.Trim(strings.TrimPrefix(field, "StreamTitle="), "'")
+		if title != i.curTitle {
+			i.curTitle = title
+			if i.onTitle != nil && title != "" {
+				i.onTitle(title)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *icyReader) Close() error {
+	return i.r.Close()
+}
+
+// openIcyStream connects to a stream asking for ICY metadata
+// servers that do not send any just give us the plain audio
+func openIcyStream(link string, onTitle func(title string)) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Icy-MetaData", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("stream returned %s", resp.Status)
+	}
+
+	metaInt, err := strconv.Atoi(resp.Header.Get("icy-metaint"))
+	if err != nil || metaInt <= 0 {
+		return resp.Body, nil
+	}
+
+	return &icyReader{
+		r:       resp.Body,
+		metaInt: metaInt,
+		left:    metaInt,
+		onTitle: onTitle,
+	}, nil
+}
+
+// startLiveEncoder connects to a live stream and starts encoding it,
+// the returned closer is nil when ffmpeg does the connecting
+func (v *VoiceInstance) startLiveEncoder(song Song, opts *dca.EncodeOptions) (*dca.EncodeSession, io.Closer, error) {
+	if isHLS(song.URL) {
+		// ffmpeg knows how to follow the segments itself
+		encodeSession, err := dca.EncodeFile(song.URL, opts)
+		return encodeSession, nil, err
+	}
+
+	stream, err := openIcyStream(song.URL, v.updateNowPlaying)
+	if err != nil {
+		log.Printf("Could not open %s ourselves, leaving it to ffmpeg: %v", song.URL, err)
+		encodeSession, err := dca.EncodeFile(song.URL, opts)
+		return encodeSession, nil, err
+	}
+
+	encodeSession, err := dca.EncodeMem(stream, opts)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+
+	return encodeSession, stream, nil
+}
+
+// playLive plays a stream that never ends, reconnecting when it drops.
+// played is true if any of it was heard.
+func (v *VoiceInstance) playLive(song Song) (played bool) {
+	opts := *dca.StdEncodeOptions
+	opts.RawOutput = true
+	opts.Bitrate = v.bitrate
+	opts.Application = "lowdelay"
+	opts.Volume = v.volume
+
+	failures := 0
+	for {
+		started := time.Now()
+		encodeSession, stream, err := v.startLiveEncoder(song, &opts)
+		if err == nil {
+			v.encoder = encodeSession
+			v.player = nil
+			ctx, cancel := context.WithCancel(context.Background())
+			mixer := dca.NewMixer(ctx, encodeSession, &opts)
+			done := make(chan error)
+			live := dca.NewStreamOptions(mixer, v.voice, done, liveStreamOptions)
+			v.stream = live
+			v.mixer = mixer
+
+			err = <-done
+			if live.PlaybackPosition() > 0 {
+				played = true
+			}
+			cancel()
+			v.mixer = nil
+			encodeSession.Cleanup()
+			if stream != nil {
+				stream.Close()
+			}
+
+			if encodeSession.Killed() || v.stop {
+				return
+			}
+		}
+
+		if time.Since(started) > time.Minute {
+			// it was playing fine for a while, this is a new drop
+			failures = 0
+		}
+		failures++
+		if failures > maxLiveReconnects {
+			log.Printf("Giving up on live stream %s: %v", song.URL, err)
+			return
+		}
+
+		var exitErr dca.ErrFFmpegExit
+		if errors.As(err, &exitErr) {
+			log.Printf("ffmpeg crashed playing live stream %s (%v), reconnecting", song.URL, err)
+		} else {
+			log.Printf("Live stream %s dropped (%v), reconnecting", song.URL, err)
+		}
+		time.Sleep(time.Duration(failures) * 2 * time.Second)
+
+		if v.stop || (v.encoder != nil && v.encoder.Killed()) {
+			return
+		}
+	}
+}
+
+// Radio handles the /radio command and its subcommands
+func (mc *MusicCommand) Radio(i *discordgo.InteractionCreate) {
+	sub := i.ApplicationCommandData().Options[0]
+	switch sub.Name {
+	case "play":
+		mc.radioPlay(i, sub.Options[0].StringValue())
+	case "add":
+		mc.radioAdd(i, sub.Options[0].StringValue(), sub.Options[1].StringValue())
+	case "remove":
+		mc.radioRemove(i, sub.Options[0].StringValue())
+	case "list":
+		mc.radioList(i)
+	}
+}
+
+func (mc *MusicCommand) radioPlay(i *discordgo.InteractionCreate, station string) {
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	v := mc.CheckVC(i, false)
+	if v == nil {
+		err := mc.Join(i, true)
+		if err != nil {
+			mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+				Content: err.Error(),
+			})
+		}
+		v = mc.CheckVC(i, true)
+		if v == nil { // try twice
+			return
+		}
+	}
+
+	// if the user is not a voice channel not accept the command
+	voiceChannelID := mc.SearchVoiceChannel(i.Member.User.ID)
+	if v.voice.ChannelID != voiceChannelID {
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "Do I know you? I was not in your VC! You need to do /join first",
+		})
+		return
+	}
+
+	song, err := mc.RadioFind(station, i.GuildID, i.Member.User.ID, i.ChannelID, v)
+	if err != nil {
+		log.Println("ERROR: Radio: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "I can't tune in to that station, give me a stream link or a preset from `/radio list`",
+		})
+		return
+	}
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: fmt.Sprintf("Video killed the radio star, but not today! Tuning in to %s", song.data.Title),
+	})
+
+	go func() {
+		mc.songSignal <- song
+	}()
+}
+
+func (mc *MusicCommand) radioAdd(i *discordgo.InteractionCreate, name, link string) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can change the radio presets")
+		return
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		mc.respondHidden(i, "That does not look like a stream link to me")
+		return
+	}
+
+	name = strings.ToLower(name)
+	err = mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		if g.RadioPresets == nil {
+			g.RadioPresets = map[string]string{}
+		}
+		g.RadioPresets[name] = link
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.respondHidden(i, "I could not save that preset, I'm sorry :(")
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("Added station %q, tune in with `/radio play %s`", name, name),
+		},
+	})
+}
+
+func (mc *MusicCommand) radioRemove(i *discordgo.InteractionCreate, name string) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can change the radio presets")
+		return
+	}
+
+	name = strings.ToLower(name)
+	if _, ok := mc.settings.Get(i.GuildID).RadioPresets[name]; !ok {
+		mc.respondHidden(i, "This server has no station with that name")
+		return
+	}
+
+	err := mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		delete(g.RadioPresets, name)
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.respondHidden(i, "I could not remove that preset, I'm sorry :(")
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("Removed station %q", name),
+		},
+	})
+}
+
+func (mc *MusicCommand) radioList(i *discordgo.InteractionCreate) {
+	presets := map[string]string{}
+	for name, link := range mc.opts.RadioPresets {
+		presets[strings.ToLower(name)] = link
+	}
+	for name, link := range mc.settings.Get(i.GuildID).RadioPresets {
+		presets[name] = link
+	}
+
+	if len(presets) == 0 {
+		mc.respondHidden(i, "No stations yet, ask a server manager to `/radio add` some")
+		return
+	}
+
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("**%s**: <%s>", name, presets[name]))
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Radio stations",
+					Description: strings.Join(lines, "\n"),
+				},
+			},
+		},
+	})
+}
+
+// respondHidden replies to an interaction with a message only the user can see
+func (mc *MusicCommand) respondHidden(i *discordgo.InteractionCreate, content string) {
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   64, // hidden
+		},
+	})
+}
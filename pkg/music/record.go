@@ -0,0 +1,425 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+const (
+	// recordingsPrefix is where recordings go in the S3 bucket, the song cache skips it
+	recordingsPrefix = "recordings/"
+	// maxRecordingLength stops recordings people forgot about
+	maxRecordingLength = 2 * time.Hour
+	// recordingLinkExpiry is how long the links to a recording work
+	recordingLinkExpiry = 7 * 24 * time.Hour
+
+	// samplesPerFrame is a 20ms opus frame at 48kHz, what discord sends
+	samplesPerFrame = 960
+)
+
+var (
+	errRecording    = errors.New("already recording")
+	errNotRecording = errors.New("not recording")
+)
+
+// recorder writes what everyone in a voice channel says to an Ogg Opus file per user.
+// Silence is filled in so all files start at the same time and can be mixed.
+type recorder struct {
+	mutex     sync.Mutex
+	dir       string
+	channelID string // text channel to post the links in
+	started   time.Time
+	users     map[uint32]string // SSRC to user ID, from the speaking updates
+	tracks    map[uint32]*track
+
+	done    chan struct{}
+	stopped chan struct{}
+	timer   *time.Timer
+}
+
+// track is the recording of one SSRC
+type track struct {
+	file *os.File
+	ogg  *dca.OggWriter
+	last uint32 // RTP timestamp of the last packet
+}
+
+// recordedTrack is a finished track file
+type recordedTrack struct {
+	userID string
+	path   string
+}
+
+func newRecorder(channelID string) (*recorder, error) {
+	dir, err := ioutil.TempDir("", "recording-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{
+		dir:       dir,
+		channelID: channelID,
+		started:   time.Now(),
+		users:     map[uint32]string{},
+		tracks:    map[uint32]*track{},
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+// receive records packets until stop is called
+func (r *recorder) receive(packets chan *discordgo.Packet) {
+	defer close(r.stopped)
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				return
+			}
+			err := r.write(p)
+			if err != nil {
+				log.Println("Error recording packet: ", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *recorder) setUser(ssrc uint32, userID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.users[ssrc] = userID
+}
+
+func (r *recorder) write(p *discordgo.Packet) error {
+	if len(p.Opus) == 0 {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	t, ok := r.tracks[p.SSRC]
+	silence := 0
+	if !ok {
+		file, err := os.Create(filepath.Join(r.dir, fmt.Sprintf("%d.ogg", p.SSRC)))
+		if err != nil {
+			return err
+		}
+		o, err := dca.NewOggWriter(file, 2)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		t = &track{file: file, ogg: o}
+		r.tracks[p.SSRC] = t
+
+		// start where the recording started
+		silence = int(time.Since(r.started) / (20 * time.Millisecond))
+	} else {
+		gap := p.Timestamp - t.last
+		if gap == 0 || gap > 1<<31 {
+			// repeated or out of order
+			return nil
+		}
+		// discord sends nothing while someone is quiet
+		silence = int(gap/samplesPerFrame) - 1
+	}
+	t.last = p.Timestamp
+
+	if max := int(maxRecordingLength / (20 * time.Millisecond)); silence > max {
+		silence = max
+	}
+	for i := 0; i < silence; i++ {
+		err := t.ogg.WriteFrame(dca.SilenceFrame)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.ogg.WriteFrame(p.Opus)
+}
+
+// stop ends the recording and returns the track files
+func (r *recorder) stop() []recordedTrack {
+	close(r.done)
+	<-r.stopped
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	tracks := []recordedTrack{}
+	for ssrc, t := range r.tracks {
+		err := t.ogg.Close()
+		if closeErr := t.file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Println("Error closing recording: ", err)
+			continue
+		}
+
+		userID := r.users[ssrc]
+		tracks = append(tracks, recordedTrack{userID, t.file.Name()})
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].path < tracks[j].path
+	})
+
+	return tracks
+}
+
+// mixTracks mixes the tracks into one file with ffmpeg
+func mixTracks(tracks []recordedTrack, out string) error {
+	args := []string{"-loglevel", "error"}
+	for _, t := range tracks {
+		args = append(args, "-i", t.path)
+	}
+	args = append(args,
+		"-filter_complex", fmt.Sprintf("amix=inputs=%d:duration=longest", len(tracks)),
+		"-acodec", "libopus",
+		"-b:a", "96000",
+		"-y", out,
+	)
+
+	output, err := exec.Command("ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// StartRecording records the voice channel, channelID is where the links go when it stops
+func (v *VoiceInstance) StartRecording(channelID string, onTimeout func()) error {
+	v.recordMutex.Lock()
+	defer v.recordMutex.Unlock()
+
+	if v.recorder != nil {
+		return errRecording
+	}
+
+	r, err := newRecorder(channelID)
+	if err != nil {
+		return err
+	}
+
+	if v.speakingVC != v.voice {
+		// handlers can not be removed, so add ours once per connection
+		v.voice.AddHandler(v.onSpeakingUpdate)
+		v.speakingVC = v.voice
+	}
+
+	r.timer = time.AfterFunc(maxRecordingLength, onTimeout)
+	v.recorder = r
+	go r.receive(v.voice.OpusRecv)
+
+	return nil
+}
+
+// StopRecording stops the recording, the caller has to remove the files
+func (v *VoiceInstance) StopRecording() (*recorder, []recordedTrack, error) {
+	v.recordMutex.Lock()
+	r := v.recorder
+	v.recorder = nil
+	v.recordMutex.Unlock()
+
+	if r == nil {
+		return nil, nil, errNotRecording
+	}
+
+	return r, r.stop(), nil
+}
+
+// Recording returns true while the voice channel is recorded
+func (v *VoiceInstance) Recording() bool {
+	v.recordMutex.Lock()
+	defer v.recordMutex.Unlock()
+	return v.recorder != nil
+}
+
+func (v *VoiceInstance) onSpeakingUpdate(vc *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+	v.recordMutex.Lock()
+	r := v.recorder
+	v.recordMutex.Unlock()
+
+	if r != nil {
+		r.setUser(uint32(vs.SSRC), vs.UserID)
+	}
+}
+
+// Record handles the /record command
+func (mc *MusicCommand) Record(i *discordgo.InteractionCreate) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can record the voice channel")
+		return
+	}
+
+	v := mc.CheckVC(i, true)
+	if v == nil {
+		return
+	}
+
+	switch i.ApplicationCommandData().Options[0].Name {
+	case "start":
+		mc.recordStart(i, v)
+	case "stop":
+		mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		content, err := mc.finishRecording(v)
+		if errors.Is(err, errNotRecording) {
+			content = "I was not recording"
+		}
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: content,
+		})
+	}
+}
+
+func (mc *MusicCommand) recordStart(i *discordgo.InteractionCreate, v *VoiceInstance) {
+	if v.voice == nil {
+		mc.respondHidden(i, "I need to be in a voice channel to record it, do /join first")
+		return
+	}
+
+	channelID := i.ChannelID
+	err := v.StartRecording(channelID, func() {
+		content, err := mc.finishRecording(v)
+		if err == nil {
+			mc.dg.ChannelMessageSend(channelID, fmt.Sprintf("Recordings stop after %s.\n%s", maxRecordingLength, content))
+		}
+	})
+	if errors.Is(err, errRecording) {
+		mc.respondHidden(i, "I am already recording, do `/record stop` first")
+		return
+	}
+	if err != nil {
+		log.Println("ERROR: starting recording: ", err)
+		mc.respondHidden(i, "I could not start recording, I'm sorry :(")
+		return
+	}
+
+	// everyone in the channel has to know, not only who asked
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf(":red_circle: **<@%s> started recording <#%s>.** "+
+				"Everything said in the voice channel from now on is recorded and uploaded. "+
+				"If you do not want to be recorded, leave the voice channel now. "+
+				"The recording stops with `/record stop` or after %s.", i.Member.User.ID, v.voice.ChannelID, maxRecordingLength),
+		},
+	})
+}
+
+// onVoiceStateUpdate tells people who join a voice channel that is being recorded,
+// they were not there when it started
+func (mc *MusicCommand) onVoiceStateUpdate(s *discordgo.Session, vs *discordgo.VoiceStateUpdate) {
+	if vs.ChannelID == "" || vs.UserID == s.State.User.ID {
+		return
+	}
+	if vs.BeforeUpdate != nil && vs.BeforeUpdate.ChannelID == vs.ChannelID {
+		// muted or deafened, they already know
+		return
+	}
+
+	v := mc.voiceInstance(vs.GuildID)
+	if v == nil || v.voice == nil || v.voice.ChannelID != vs.ChannelID {
+		return
+	}
+
+	v.recordMutex.Lock()
+	r := v.recorder
+	v.recordMutex.Unlock()
+	if r == nil {
+		return
+	}
+
+	_, err := mc.dg.ChannelMessageSend(r.channelID, fmt.Sprintf(":red_circle: **<@%s>, <#%s> is being recorded.** "+
+		"Everything you say in it is recorded and uploaded. "+
+		"If you do not want to be recorded, leave the voice channel now.", vs.UserID, vs.ChannelID))
+	if err != nil {
+		log.Println("ERROR: telling someone about the recording: ", err)
+	}
+}
+
+// finishRecording stops recording, uploads the files and returns the message with the links
+func (mc *MusicCommand) finishRecording(v *VoiceInstance) (string, error) {
+	r, tracks, err := v.StopRecording()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(r.dir)
+
+	if len(tracks) == 0 {
+		return ":stop_button: Recording stopped, nobody said anything", nil
+	}
+
+	prefix := fmt.Sprintf("%s%s/%s/", recordingsPrefix, v.guildID, r.started.UTC().Format("20060102-150405"))
+
+	lines := []string{}
+	// name is who it is for people, file what it is called in the bucket
+	upload := func(name, file, path string) {
+		link, err := mc.uploadRecording(prefix+file+".ogg", path)
+		if err != nil {
+			log.Println("ERROR: uploading recording: ", err)
+			lines = append(lines, fmt.Sprintf("%s: upload failed", name))
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%s: <%s>", name, link))
+	}
+
+	if len(tracks) > 1 {
+		mixed := filepath.Join(r.dir, "mixed.ogg")
+		err := mixTracks(tracks, mixed)
+		if err != nil {
+			log.Println("ERROR: mixing recording: ", err)
+		} else {
+			upload("everyone", "everyone", mixed)
+		}
+	}
+
+	for n, t := range tracks {
+		name := fmt.Sprintf("unknown-%d", n+1)
+		file := name
+		if t.userID != "" {
+			// people can have the same name, the user ID keeps their files apart
+			name = v.requesterName(t.userID)
+			file = strings.ReplaceAll(name, "/", "_") + "-" + t.userID
+		}
+		upload(name, file, t.path)
+	}
+
+	return fmt.Sprintf(":stop_button: Recording stopped, the links work for %d days:\n%s", int(recordingLinkExpiry.Hours()/24), strings.Join(lines, "\n")), nil
+}
+
+// uploadRecording puts a file in the S3 bucket and returns a link to it
+func (mc *MusicCommand) uploadRecording(key, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = mc.recordings.Put(key, f, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return mc.recordings.Link(key, recordingLinkExpiry)
+}
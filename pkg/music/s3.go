@@ -3,16 +3,23 @@ package music
 import (
 	"fmt"
 	"io"
+	"mime"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// S3 is a SongCache in an S3 bucket
 type S3 struct {
-	client *s3.S3
-	bucket string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
 }
 
 func NewS3(endpoint, region, bucket, access, secret string) (*S3, error) {
@@ -34,11 +41,23 @@ func NewS3(endpoint, region, bucket, access, secret string) (*S3, error) {
 	s3Client := s3.New(sess)
 
 	return &S3{
-		client: s3Client,
-		bucket: bucket,
+		client:   s3Client,
+		uploader: s3manager.NewUploaderWithClient(s3Client),
+		bucket:   bucket,
 	}, nil
 }
 
+// isNotFound checks if S3 told us the object does not exist
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
 func (s *S3) Get(file string) (io.ReadCloser, error) {
 	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
@@ -46,6 +65,9 @@ func (s *S3) Get(file string) (io.ReadCloser, error) {
 	}
 
 	result, err := s.client.GetObject(input)
+	if isNotFound(err) {
+		return nil, ErrNotCached
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get object: %v", err)
 	}
@@ -53,17 +75,112 @@ func (s *S3) Get(file string) (io.ReadCloser, error) {
 	return result.Body, nil
 }
 
-func (s *S3) Put(file string, data io.ReadSeeker) error {
-	input := &s3.PutObjectInput{
+// Put uploads in parts as data comes in, a failed read aborts the upload
+func (s *S3) Put(file string, data io.Reader, meta map[string]string) error {
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(file),
+		Body:     data,
+		Metadata: map[string]*string{},
+	}
+	for k, v := range meta {
+		// S3 metadata is sent as HTTP headers, those have to be ASCII
+		input.Metadata[k] = aws.String(mime.QEncoding.Encode("utf-8", v))
+	}
+
+	_, err := s.uploader.Upload(input)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: %v", err)
+	}
+
+	return nil
+}
+
+func (s *S3) Stat(file string) (*CacheObject, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(file),
+	}
+
+	result, err := s.client.HeadObject(input)
+	if isNotFound(err) {
+		return nil, ErrNotCached
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object: %v", err)
+	}
+
+	meta := map[string]string{}
+	dec := new(mime.WordDecoder)
+	for k, v := range result.Metadata {
+		decoded, err := dec.DecodeHeader(aws.StringValue(v))
+		if err != nil {
+			decoded = aws.StringValue(v)
+		}
+		// S3 returns the keys capitalized like HTTP headers
+		meta[strings.ToLower(k)] = decoded
+	}
+
+	return &CacheObject{
+		Key:      file,
+		Size:     aws.Int64Value(result.ContentLength),
+		Modified: aws.TimeValue(result.LastModified),
+		Metadata: meta,
+	}, nil
+}
+
+func (s *S3) Delete(file string) error {
+	input := &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(file),
-		Body:   data,
 	}
 
-	_, err := s.client.PutObject(input)
+	_, err := s.client.DeleteObject(input)
 	if err != nil {
-		return fmt.Errorf("failed to put object: %v", err)
+		return fmt.Errorf("failed to delete object: %v", err)
 	}
 
 	return nil
 }
+
+func (s *S3) List() ([]*CacheObject, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+
+	out := []*CacheObject{}
+	err := s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			if strings.HasPrefix(aws.StringValue(o.Key), recordingsPrefix) {
+				// recordings are not songs
+				continue
+			}
+			out = append(out, &CacheObject{
+				Key:      aws.StringValue(o.Key),
+				Size:     aws.Int64Value(o.Size),
+				Modified: aws.TimeValue(o.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
+
+	return out, nil
+}
+
+// Link returns a presigned link to download a file, valid for expires
+func (s *S3) Link(file string, expires time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(file),
+	})
+
+	link, err := req.Presign(expires)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign object: %v", err)
+	}
+
+	return link, nil
+}
@@ -0,0 +1,122 @@
+package music
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// GuildSettings are the settings a guild can change for itself
+type GuildSettings struct {
+	RadioPresets map[string]string `json:"radioPresets,omitempty"`
+	Sounds       map[string]string `json:"sounds,omitempty"` // sound name to the uploaded file
+
+	Announce         bool   `json:"announce,omitempty"`         // speak the next song between songs
+	AnnounceLanguage string `json:"announceLanguage,omitempty"` // language of the TTS voice, eg. en or nl
+
+	Autoplay AutoplayMode `json:"autoplay,omitempty"` // where to find songs when the queue is empty
+}
+
+// settingsStore keeps the settings of all guilds in a JSON file
+type settingsStore struct {
+	mutex  sync.Mutex
+	path   string
+	guilds map[string]*GuildSettings
+}
+
+func newSettingsStore(path string) (*settingsStore, error) {
+	s := &settingsStore{
+		path:   path,
+		guilds: map[string]*GuildSettings{},
+	}
+
+	err := readJSONFile(path, &s.guilds)
+	if err != nil {
+		return nil, fmt.Errorf("error reading settings: %w", err)
+	}
+
+	return s, nil
+}
+
+// Get returns the settings of a guild, the maps in it must not be changed
+func (s *settingsStore) Get(guildID string) GuildSettings {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if g, ok := s.guilds[guildID]; ok {
+		return *g
+	}
+	return GuildSettings{}
+}
+
+// Update changes the settings of a guild and writes them to disk
+func (s *settingsStore) Update(guildID string, fn func(g *GuildSettings)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// work on a copy so settings handed out by Get never change under their reader
+	g := &GuildSettings{}
+	if old, ok := s.guilds[guildID]; ok {
+		data, err := json.Marshal(old)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, g)
+		if err != nil {
+			return err
+		}
+	}
+
+	fn(g)
+	s.guilds[guildID] = g
+
+	return writeJSONFile(s.path, s.guilds)
+}
+
+// readJSONFile reads a file written by writeJSONFile, a missing file is not an error
+func readJSONFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile saves v as JSON in path
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write next to it first so a crash never leaves us with half a file
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// isAdmin checks if the member that sent the interaction can manage the guild
+func isAdmin(i *discordgo.InteractionCreate) bool {
+	if i.Member == nil {
+		return false
+	}
+	return i.Member.Permissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0
+}
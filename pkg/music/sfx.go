@@ -0,0 +1,352 @@
+package music
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/meyskens/thomas-disco/pkg/dca"
+)
+
+const (
+	maxSoundSize   = 1024 * 1024      // max size in bytes of an uploaded sound
+	maxSoundLength = 15 * time.Second // max length of a sound, they go over the music
+)
+
+// soundName is what a sound can be called, names end up in file names
+var soundName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// soundPath looks up a sound, guild sounds go before the global ones
+func (m *MusicCommand) soundPath(guildID, name string) (string, bool) {
+	name = strings.ToLower(name)
+	if p, ok := m.settings.Get(guildID).Sounds[name]; ok {
+		return p, true
+	}
+	for n, p := range m.opts.Sounds {
+		if strings.ToLower(n) == name {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// PlaySound plays a clip over the song that is playing, or on its own if nothing is
+func (v *VoiceInstance) PlaySound(clip string, length time.Duration) error {
+	v.sfxMutex.Lock()
+	defer v.sfxMutex.Unlock()
+
+	if mixer := v.mixer; mixer != nil {
+		err := v.mixSound(mixer, clip, length)
+		if err == nil || errors.Is(err, dca.ErrMixing) {
+			return err
+		}
+		log.Println("Could not mix sound, interrupting the music instead: ", err)
+	}
+
+	stream := v.stream
+	if v.speaking && stream != nil {
+		// pause the music, play the clip, resume
+		stream.SetPaused(true)
+		defer func() {
+			if !v.pause {
+				stream.SetPaused(false)
+			}
+		}()
+	} else {
+		v.voice.Speaking(true)
+		defer func() {
+			// a song might have started in the meantime
+			v.voice.Speaking(v.speaking)
+		}()
+	}
+
+	return v.playClip(clip)
+}
+
+// mixSound mixes a clip over the music, starting with the frames the stream read ahead
+// so the clip does not wait for the buffer to play out
+func (v *VoiceInstance) mixSound(mixer *dca.Mixer, clip string, length time.Duration) error {
+	if mixer.Mixing() {
+		return dca.ErrMixing
+	}
+
+	var err error
+	flushed := v.stream != nil && v.stream.Flush(func(frames [][]byte) {
+		mixer.Unread(frames)
+		err = mixer.Play(clip, length)
+	})
+	if !flushed {
+		err = mixer.Play(clip, length)
+	}
+	return err
+}
+
+// playClip plays a clip on its own
+func (v *VoiceInstance) playClip(clip string) error {
+	opts := *dca.StdEncodeOptions
+	opts.RawOutput = true
+	opts.Bitrate = v.bitrate
+	opts.Application = "lowdelay"
+	opts.Volume = v.volume
+
+	encodeSession, err := dca.EncodeFile(clip, &opts)
+	if err != nil {
+		return err
+	}
+	defer encodeSession.Cleanup()
+
+	done := make(chan error)
+	dca.NewStream(encodeSession, v.voice, done)
+	err = <-done
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Sfx handles the /sfx command
+func (mc *MusicCommand) Sfx(i *discordgo.InteractionCreate) {
+	v := mc.CheckVC(i, true)
+	if v == nil {
+		return
+	}
+
+	// if the user is not a voice channel not accept the command
+	voiceChannelID := mc.SearchVoiceChannel(i.Member.User.ID)
+	if v.voice == nil || v.voice.ChannelID != voiceChannelID {
+		mc.respondHidden(i, "Do I know you? I was not in your VC! You need to do /join first")
+		return
+	}
+
+	name := i.ApplicationCommandData().Options[0].StringValue()
+	clip, ok := mc.soundPath(i.GuildID, name)
+	if !ok {
+		mc.respondHidden(i, "I don't know that sound, see `/soundboard list`")
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+
+	probe, err := dca.Probe(clip)
+	if err != nil {
+		log.Println("ERROR: Sound probe: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "That sound seems to be broken :(",
+		})
+		return
+	}
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: fmt.Sprintf(":loud_sound: %s", strings.ToLower(name)),
+	})
+
+	go func() {
+		err := v.PlaySound(clip, probe.Format.ParsedDuration())
+		if errors.Is(err, dca.ErrMixing) {
+			mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+				Content: "One sound at a time please!",
+			})
+		} else if err != nil {
+			log.Println("ERROR: Playing sound: ", err)
+		}
+	}()
+}
+
+// Soundboard handles the /soundboard command and its subcommands, attachment is the uploaded file if any
+func (mc *MusicCommand) Soundboard(i *discordgo.InteractionCreate, attachment *discordgo.MessageAttachment) {
+	sub := i.ApplicationCommandData().Options[0]
+	switch sub.Name {
+	case "add":
+		mc.soundAdd(i, sub.Options[0].StringValue(), attachment)
+	case "remove":
+		mc.soundRemove(i, sub.Options[0].StringValue())
+	case "list":
+		mc.soundList(i)
+	}
+}
+
+func (mc *MusicCommand) soundAdd(i *discordgo.InteractionCreate, name string, attachment *discordgo.MessageAttachment) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can change the soundboard")
+		return
+	}
+
+	name = strings.ToLower(name)
+	if !soundName.MatchString(name) {
+		mc.respondHidden(i, "Sound names can only have letters, numbers, - and _")
+		return
+	}
+	if attachment == nil {
+		mc.respondHidden(i, "You need to give me a file for that sound!")
+		return
+	}
+	if attachment.Size > maxSoundSize {
+		mc.respondHidden(i, fmt.Sprintf("That sound is too big, I can only take up to %d kB", maxSoundSize/1024))
+		return
+	}
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+
+	file, err := mc.saveSound(i.GuildID, name, attachment)
+	if err != nil {
+		log.Println("ERROR: saving sound: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: fmt.Sprintf("I could not use that file, sounds have to be audio of at most %s", maxSoundLength),
+		})
+		return
+	}
+
+	old, replaced := mc.settings.Get(i.GuildID).Sounds[name]
+	err = mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		if g.Sounds == nil {
+			g.Sounds = map[string]string{}
+		}
+		g.Sounds[name] = file
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+			Content: "I could not save that sound, I'm sorry :(",
+		})
+		return
+	}
+	if replaced && old != file {
+		os.Remove(old)
+	}
+
+	mc.dg.InteractionResponseEdit(mc.dg.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Content: fmt.Sprintf("Added sound %q, play it with `/sfx %s`", name, name),
+	})
+}
+
+// saveSound downloads an uploaded sound into the data directory and checks it
+func (mc *MusicCommand) saveSound(guildID, name string, attachment *discordgo.MessageAttachment) (string, error) {
+	dir := filepath.Join(mc.opts.DataDir, "sounds", guildID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := fileClient.Get(attachment.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download returned %s", resp.Status)
+	}
+
+	// the sound it replaces stays until this one checks out
+	ext := strings.ToLower(path.Ext(attachment.Filename))
+	f, err := ioutil.TempFile(dir, ".upload-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	_, err = io.Copy(f, io.LimitReader(resp.Body, maxSoundSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	probe, err := dca.Probe(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if length := probe.Format.ParsedDuration(); length <= 0 || length > maxSoundLength {
+		os.Remove(tmp)
+		return "", fmt.Errorf("sound is %s long", length)
+	}
+
+	file := filepath.Join(dir, name+ext)
+	err = os.Rename(tmp, file)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return file, nil
+}
+
+func (mc *MusicCommand) soundRemove(i *discordgo.InteractionCreate, name string) {
+	if !isAdmin(i) {
+		mc.respondHidden(i, "Only server managers can change the soundboard")
+		return
+	}
+
+	name = strings.ToLower(name)
+	file, ok := mc.settings.Get(i.GuildID).Sounds[name]
+	if !ok {
+		mc.respondHidden(i, "This server has no sound with that name")
+		return
+	}
+
+	err := mc.settings.Update(i.GuildID, func(g *GuildSettings) {
+		delete(g.Sounds, name)
+	})
+	if err != nil {
+		log.Println("ERROR: saving settings: ", err)
+		mc.respondHidden(i, "I could not remove that sound, I'm sorry :(")
+		return
+	}
+	os.Remove(file)
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: fmt.Sprintf("Removed sound %q", name),
+		},
+	})
+}
+
+func (mc *MusicCommand) soundList(i *discordgo.InteractionCreate) {
+	sounds := map[string]bool{}
+	for name := range mc.opts.Sounds {
+		sounds[strings.ToLower(name)] = true
+	}
+	for name := range mc.settings.Get(i.GuildID).Sounds {
+		sounds[name] = true
+	}
+
+	if len(sounds) == 0 {
+		mc.respondHidden(i, "No sounds yet, ask a server manager to `/soundboard add` some")
+		return
+	}
+
+	names := []string{}
+	for name := range sounds {
+		names = append(names, "`"+name+"`")
+	}
+	sort.Strings(names)
+
+	mc.dg.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Embeds: []*discordgo.MessageEmbed{
+				{
+					Title:       "Soundboard",
+					Description: strings.Join(names, " "),
+				},
+			},
+		},
+	})
+}
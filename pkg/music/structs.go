@@ -1,5 +1,10 @@
 package music
 
+import (
+	"strings"
+	"time"
+)
+
 type TimeDuration struct {
 	Day    int
 	Hour   int
@@ -7,6 +12,24 @@ type TimeDuration struct {
 	Second int
 }
 
+// SongSource tells where the audio of a song comes from
+type SongSource string
+
+const (
+	// SourceYouTube is a YouTube video, VidID holds the video ID
+	SourceYouTube SongSource = "youtube"
+	// SourceYTDLP is any other site yt-dlp has an extractor for, URL holds the page to play
+	SourceYTDLP SongSource = "ytdlp"
+	// SourceFile is an audio file ffmpeg can read directly, URL holds the link to it
+	SourceFile SongSource = "file"
+	// SourceLive is a radio or other stream without an end, it is never cached
+	SourceLive SongSource = "live"
+	// SourcePodcast is a podcast episode, URL holds the enclosure and VidID the episode GUID
+	SourcePodcast SongSource = "podcast"
+	// SourceLibrary is a file from the local music library, URL holds the path on disk
+	SourceLibrary SongSource = "library"
+)
+
 type Song struct {
 	ChannelID string
 	User      string
@@ -14,6 +37,40 @@ type Song struct {
 	VidID     string
 	Title     string
 	Duration  string
+
+	Source    SongSource
+	Extractor string // yt-dlp extractor name, eg. soundcloud
+	URL       string
+	Thumbnail string
+	Start     time.Duration // where in the song to start playing
+	Query     string        // the search or link that found the song, so the cache index can skip it next time
+	Autoplay  bool          // picked by autoplay, nobody asked for it
+}
+
+// CacheKey returns the key the song is stored under in the song cache
+func (s Song) CacheKey() string {
+	if s.Source == SourceYTDLP {
+		// keep other sites out of the YouTube ID namespace
+		return strings.ToLower(s.Extractor) + "/" + s.VidID
+	}
+	return s.VidID
+}
+
+// Cacheable returns false for songs we play straight from their URL
+func (s Song) Cacheable() bool {
+	switch s.Source {
+	case SourceFile, SourceLive, SourcePodcast, SourceLibrary:
+		return false
+	}
+	return true
+}
+
+// StreamURL returns what yt-dlp needs to fetch the audio
+func (s Song) StreamURL() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	return s.VidID
 }
 
 type PkgSong struct {
@@ -49,12 +49,17 @@ func getDuration(stringRawFull, stringRawOffset string) (stringRemain string) {
 	// substact the time offset
 	duration.Second = secondsFull - secondsOffset
 
-	if duration.Second <= 0 {
+	return formatDuration(duration.Second)
+}
+
+// formatDuration prints a number of seconds the way we show song lengths
+func formatDuration(seconds int) string {
+	if seconds <= 0 {
 		return "0:00"
 	}
 
 	// print the time
-	t := AddTimeDuration(duration)
+	t := AddTimeDuration(TimeDuration{Second: seconds})
 	if t.Day == 0 && t.Hour == 0 {
 		return fmt.Sprintf("%02d:%02d", t.Minute, t.Second)
 	}
@@ -83,6 +88,14 @@ func (m *MusicCommand) YoutubeFind(searchString, uID, chID string, v *VoiceInsta
 		}
 	}
 
+	if entry, ok := m.index.FindQuery(searchString); ok && timeOffset == "" {
+		// we played this before, no need to ask YouTube
+		song_struct.data = entry.Song(uID, chID)
+		song_struct.data.Query = searchString
+		song_struct.v = v
+		return
+	}
+
 	var audioId, audioTitle, duration string
 	audioId, audioTitle, duration, err = m.OfficialSearch(searchString)
 	if err != nil {
@@ -109,12 +122,16 @@ func (m *MusicCommand) YoutubeFind(searchString, uID, chID string, v *VoiceInsta
 	durationString := getDuration(duration, timeOffset)
 
 	song := Song{
-		chID,
-		uID,
-		uID,
-		vid.ID,
-		audioTitle,
-		durationString,
+		ChannelID: chID,
+		User:      uID,
+		ID:        uID,
+		VidID:     vid.ID,
+		Title:     audioTitle,
+		Duration:  durationString,
+		Source:    SourceYouTube,
+		URL:       "https://www.youtube.com/watch?v=" + vid.ID,
+		Thumbnail: fmt.Sprintf("https://i.ytimg.com/vi/%s/hqdefault.jpg", vid.ID),
+		Query:     searchString,
 	}
 
 	song_struct.data = song
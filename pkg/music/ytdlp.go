@@ -0,0 +1,174 @@
+package music
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// youtubeHosts are handled by the YouTube search instead of the generic yt-dlp extractors
+var youtubeHosts = map[string]bool{
+	"youtube.com":       true,
+	"www.youtube.com":   true,
+	"m.youtube.com":     true,
+	"music.youtube.com": true,
+	"youtu.be":          true,
+}
+
+// isDirectURL returns true if the query is a link to a non YouTube site
+func isDirectURL(query string) bool {
+	u, err := url.Parse(query)
+	if err != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return u.Hostname() != "" && !youtubeHosts[strings.ToLower(u.Hostname())]
+}
+
+// ytdlpInfo is the part of the yt-dlp --dump-json output we care about
+type ytdlpInfo struct {
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	Duration   float64 `json:"duration"`
+	Thumbnail  string  `json:"thumbnail"`
+	Extractor  string  `json:"extractor_key"`
+	WebpageURL string  `json:"webpage_url"`
+	IsLive     bool    `json:"is_live"`
+	Uploader   string  `json:"uploader"`
+	URL        string  `json:"url"` // where an entry of a flat playlist is
+}
+
+func ytdlpDumpJSON(link string) (*ytdlpInfo, error) {
+	var stdout, stderr bytes.Buffer
+
+	yt := exec.Command("yt-dlp", "--dump-json", "--no-playlist", link)
+	yt.Stdout = &stdout
+	yt.Stderr = &stderr
+
+	err := yt.Run()
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	info := &ytdlpInfo{}
+	err = json.Unmarshal(stdout.Bytes(), info)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing yt-dlp output: %w", err)
+	}
+
+	return info, nil
+}
+
+// ytdlpFlatPlaylist lists the first max entries of a playlist without looking at each of them,
+// a max of 0 or less lists all of them
+func ytdlpFlatPlaylist(link string, max int) ([]*ytdlpInfo, error) {
+	var stdout, stderr bytes.Buffer
+
+	args := []string{"--flat-playlist", "--dump-json"}
+	if max > 0 {
+		args = append(args, "--playlist-end", strconv.Itoa(max))
+	}
+	yt := exec.Command("yt-dlp", append(args, link)...)
+	yt.Stdout = &stdout
+	yt.Stderr = &stderr
+
+	err := yt.Run()
+	if err != nil {
+		return nil, fmt.Errorf("yt-dlp failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// one JSON object per entry
+	entries := []*ytdlpInfo{}
+	decoder := json.NewDecoder(&stdout)
+	for decoder.More() {
+		info := &ytdlpInfo{}
+		err = decoder.Decode(info)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing yt-dlp output: %w", err)
+		}
+		if info.ID != "" {
+			entries = append(entries, info)
+		}
+	}
+
+	return entries, nil
+}
+
+// YTDLPFind resolves a link to any site yt-dlp supports into a song
+func (m *MusicCommand) YTDLPFind(link, uID, chID string, v *VoiceInstance) (song_struct PkgSong, err error) {
+	if entry, ok := m.index.FindQuery(link); ok {
+		// we played this before, no need to ask yt-dlp
+		song_struct.data = entry.Song(uID, chID)
+		song_struct.data.Query = link
+		song_struct.v = v
+		return
+	}
+
+	info, err := ytdlpDumpJSON(link)
+	if err != nil {
+		return
+	}
+
+	if info.IsLive {
+		err = errors.New("live streams are not supported")
+		return
+	}
+
+	if info.ID == "" || info.Extractor == "" {
+		err = errors.New("no song found")
+		return
+	}
+
+	song_struct.data = info.song(link)
+	song_struct.data.ChannelID = chID
+	song_struct.data.User = uID
+	song_struct.data.ID = uID
+	song_struct.v = v
+
+	return
+}
+
+// song turns what yt-dlp found into a song, link is what it was asked for
+func (info *ytdlpInfo) song(link string) Song {
+	if info.Extractor == "Youtube" {
+		// keep YouTube videos under their ID so the YouTube search finds them in the cache
+		return Song{
+			VidID:     info.ID,
+			Title:     info.Title,
+			Duration:  formatDuration(int(info.Duration)),
+			Source:    SourceYouTube,
+			URL:       "https://www.youtube.com/watch?v=" + info.ID,
+			Thumbnail: fmt.Sprintf("https://i.ytimg.com/vi/%s/hqdefault.jpg", info.ID),
+			Query:     link,
+		}
+	}
+
+	title := info.Title
+	if info.Uploader != "" && !strings.Contains(title, info.Uploader) {
+		title = fmt.Sprintf("%s - %s", info.Uploader, info.Title)
+	}
+
+	pageURL := info.WebpageURL
+	if pageURL == "" {
+		pageURL = link
+	}
+
+	return Song{
+		VidID:     info.ID,
+		Title:     title,
+		Duration:  formatDuration(int(info.Duration)),
+		Source:    SourceYTDLP,
+		Extractor: info.Extractor,
+		URL:       pageURL,
+		Thumbnail: info.Thumbnail,
+		Query:     link,
+	}
+}